@@ -0,0 +1,127 @@
+package fsm
+
+import (
+	"container/list"
+	"reflect"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// StateCacheKey identifies the state of a workflow run after a given decision.
+type StateCacheKey struct {
+	WorkflowID   string
+	RunID        string
+	StateVersion uint64
+}
+
+// CachedState is the deserialized state data and event correlator of a workflow run, as recorded by a decision task.
+type CachedState struct {
+	StateName  string
+	Data       interface{}
+	Correlator *EventCorrelator
+}
+
+// StateCache lets the FSM skip deserializing state data and the event correlator from history
+// when it has already seen them in a previous decision task for the same workflow run.
+//
+// The FSM puts the final state of a decision task into the cache only once the task was completed successfully,
+// and takes it back out when the next decision task finds the matching StateVersion in history.
+// Take must remove the entry, as the FSM hands the cached data to deciders which are free to mutate it.
+type StateCache interface {
+	Take(key StateCacheKey) *CachedState
+	Put(key StateCacheKey, state *CachedState)
+}
+
+// LRUStateCache is a StateCache that holds a bounded number of entries, evicting the least recently used.
+type LRUStateCache struct {
+	size    int
+	mu      sync.Mutex
+	entries *list.List
+	index   map[StateCacheKey]*list.Element
+}
+
+type lruEntry struct {
+	key   StateCacheKey
+	state *CachedState
+}
+
+// NewLRUStateCache creates an LRUStateCache that holds at most size entries.
+func NewLRUStateCache(size int) *LRUStateCache {
+	return &LRUStateCache{
+		size:    size,
+		entries: list.New(),
+		index:   make(map[StateCacheKey]*list.Element),
+	}
+}
+
+// Take removes and returns the cached state for key, or nil if there is none.
+func (c *LRUStateCache) Take(key StateCacheKey) *CachedState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[key]
+	if !ok {
+		return nil
+	}
+	c.entries.Remove(e)
+	delete(c.index, key)
+	return e.Value.(*lruEntry).state
+}
+
+// Put caches state under key, evicting the least recently used entries if the cache is full.
+func (c *LRUStateCache) Put(key StateCacheKey, state *CachedState) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.index[key]; ok {
+		e.Value.(*lruEntry).state = state
+		c.entries.MoveToFront(e)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&lruEntry{key: key, state: state})
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *LRUStateCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// DataCopier makes a deep copy of fsm state data. The FSM copies the data before each decider runs,
+// so that the DecisionErrorHandler can be given the data as it was before the failed decision.
+type DataCopier func(data interface{}) (interface{}, error)
+
+// SerializingDataCopier returns a DataCopier that copies data by round tripping it through serializer.
+// This is what the FSM uses when no DataCopier is set.
+func SerializingDataCopier(serializer StateSerializer) DataCopier {
+	return func(data interface{}) (interface{}, error) {
+		if data == nil {
+			return nil, nil
+		}
+		serialized, err := serializer.Serialize(data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		t := reflect.TypeOf(data)
+		if t.Kind() == reflect.Ptr {
+			copied := reflect.New(t.Elem()).Interface()
+			if err := serializer.Deserialize(serialized, copied); err != nil {
+				return nil, errors.Trace(err)
+			}
+			return copied, nil
+		}
+		copied := reflect.New(t)
+		if err := serializer.Deserialize(serialized, copied.Interface()); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return copied.Elem().Interface(), nil
+	}
+}
@@ -0,0 +1,200 @@
+package fsm
+
+import (
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+type countingSerializer struct {
+	JSONStateSerializer
+	serializations   int
+	deserializations int
+}
+
+func (c *countingSerializer) Serialize(state interface{}) (string, error) {
+	c.serializations++
+	return c.JSONStateSerializer.Serialize(state)
+}
+
+func (c *countingSerializer) Deserialize(serialized string, state interface{}) error {
+	c.deserializations++
+	return c.JSONStateSerializer.Deserialize(serialized, state)
+}
+
+func TestLRUStateCache(t *testing.T) {
+	cache := NewLRUStateCache(2)
+	one := StateCacheKey{WorkflowID: "wf", RunID: "run", StateVersion: 1}
+	two := StateCacheKey{WorkflowID: "wf", RunID: "run", StateVersion: 2}
+	three := StateCacheKey{WorkflowID: "wf", RunID: "run", StateVersion: 3}
+
+	cache.Put(one, &CachedState{StateName: "one"})
+	cache.Put(two, &CachedState{StateName: "two"})
+	cache.Put(three, &CachedState{StateName: "three"})
+
+	if cache.Len() != 2 {
+		t.Fatal("expected 2 entries", cache.Len())
+	}
+
+	if cache.Take(one) != nil {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+
+	if s := cache.Take(two); s == nil || s.StateName != "two" {
+		t.Fatal("expected entry two", s)
+	}
+
+	if cache.Take(two) != nil {
+		t.Fatal("expected Take to remove the entry")
+	}
+}
+
+func TestSerializingDataCopier(t *testing.T) {
+	copier := SerializingDataCopier(JSONStateSerializer{})
+	data := &TestData{States: []string{"a"}}
+	copied, err := copier(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied.(*TestData).States[0] = "b"
+	if data.States[0] != "a" {
+		t.Fatal("copy is not deep")
+	}
+
+	copied, err = copier(TestData{States: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.(TestData).States[0] != "a" {
+		t.Fatal("bad copy of non pointer data", copied)
+	}
+}
+
+func TestStateCacheSkipsDeserialization(t *testing.T) {
+	serializer := &countingSerializer{}
+	fsm := testFSM()
+	fsm.Serializer = serializer
+	fsm.SWF = &MockClient{}
+	fsm.StateCache = NewLRUStateCache(10)
+	fsm.DataCopier = func(data interface{}) (interface{}, error) {
+		d := data.(*TestData)
+		return &TestData{States: append([]string{}, d.States...)}, nil
+	}
+
+	fsm.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			testData := data.(*TestData)
+			testData.States = append(testData.States, *h.EventType)
+			return f.Stay(testData, nil)
+		},
+	})
+
+	events := []swf.HistoryEvent{
+		swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventID: I(3)},
+		swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventID: I(2)},
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S("WorkflowExecutionStarted"),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	}
+	first := testDecisionTask(0, events)
+	_, decisions, _, err := fsm.Tick(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsm.handleDecisionTask(first)
+
+	secondEvents := []swf.HistoryEvent{
+		{
+			EventType: S(swf.EventTypeWorkflowExecutionSignaled),
+			EventID:   I(6),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{
+				SignalName: S("hi"),
+			},
+		},
+		{
+			EventType: S(swf.EventTypeMarkerRecorded),
+			EventID:   I(5),
+			MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+				MarkerName: S(StateMarker),
+				Details:    FindDecision(decisions, stateMarkerPredicate).RecordMarkerDecisionAttributes.Details,
+			},
+		},
+	}
+	secondEvents = append(secondEvents, events...)
+	second := testDecisionTask(3, secondEvents)
+
+	serializer.deserializations = 0
+	serializer.serializations = 0
+	ctx, _, state, err := fsm.Tick(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serializer.deserializations != 0 {
+		t.Fatal("expected cached state data to be used", serializer.deserializations)
+	}
+	if serializer.serializations != 1 {
+		t.Fatal("expected the state data to be serialized once", serializer.serializations)
+	}
+	if len(ctx.stateData.(*TestData).States) != 2 || state.StateVersion != 2 {
+		t.Fatal("unexpected state", ctx.stateData, state)
+	}
+
+	//the entry was taken, so a second attempt at the same decision task deserializes from history
+	ctx, _, _, err = fsm.Tick(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serializer.deserializations == 0 {
+		t.Fatal("expected state data to be deserialized")
+	}
+	if len(ctx.stateData.(*TestData).States) != 2 {
+		t.Fatal("unexpected state", ctx.stateData)
+	}
+}
+
+func TestStateIsCachedAfterReplication(t *testing.T) {
+	fsm := testFSM()
+	fsm.SWF = &MockClient{}
+	fsm.StateCache = NewLRUStateCache(10)
+	fsm.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			testData := data.(*TestData)
+			testData.States = append(testData.States, *h.EventType)
+			return f.Stay(testData, nil)
+		},
+	})
+	replicated := false
+	fsm.ReplicationHandler = func(ctx *FSMContext, task *swf.DecisionTask, complete *swf.RespondDecisionTaskCompletedInput, state *SerializedState) error {
+		//the next decision task of the workflow changes the cached data, as a concurrent dispatcher could while replication reads it
+		if cached := fsm.StateCache.Take(fsm.stateCacheKey(task, state)); cached != nil {
+			cached.Data.(*TestData).States = append(cached.Data.(*TestData).States, "changed")
+		}
+		if fsm.Serialize(ctx.stateData) != state.StateData {
+			t.Fatal("expected the state to be unchanged while it is replicated", ctx.stateData)
+		}
+		replicated = true
+		return nil
+	}
+	fsm.Init()
+
+	task := testDecisionTask(0, []swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	})
+	fsm.handleDecisionTask(task)
+	if !replicated || fsm.StateCache.(*LRUStateCache).Len() != 1 {
+		t.Fatal("expected the state to be replicated, then cached")
+	}
+}
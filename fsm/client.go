@@ -3,6 +3,7 @@ package fsm
 import (
 	"fmt"
 	"log"
+	"reflect"
 
 	"time"
 
@@ -18,10 +19,18 @@ type FSMClient interface {
 	ListClosedIds() ([]string, string, error)
 	ListNextClosedIds(previousPageToken string) ([]string, string, error)
 	GetState(id string) (string, interface{}, error)
+	GetErrorState(id string) (*SerializedErrorState, error)
 	Signal(id string, signal string, input interface{}) error
 	Start(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (*swf.Run, error)
+	StartIfAbsent(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (*swf.Run, bool, error)
+	StartOrSignal(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}, signal string, signalInput interface{}) (*swf.Run, bool, error)
+	ClosedSince(id string, since time.Time) (*swf.WorkflowExecution, error)
 }
 
+// MaxStartAttempts is how many times StartIfAbsent and StartOrSignal try to start a workflow, when the execution that has its ID
+// closes before they find or signal it.
+const MaxStartAttempts = 3
+
 type ClientSWFOps interface {
 	ListOpenWorkflowExecutions(req *swf.ListOpenWorkflowExecutionsInput) (resp *swf.WorkflowExecutionInfos, err error)
 	ListClosedWorkflowExecutions(req *swf.ListClosedWorkflowExecutionsInput) (resp *swf.WorkflowExecutionInfos, err error)
@@ -112,28 +121,53 @@ func (c *client) listIds(executionInfosFunc func() (*swf.WorkflowExecutionInfos,
 }
 
 func (c *client) GetState(id string) (string, interface{}, error) {
-	var execution *swf.WorkflowExecution
-	open, err := c.c.ListOpenWorkflowExecutions(&swf.ListOpenWorkflowExecutionsInput{
-		Domain:          S(c.f.Domain),
-		MaximumPageSize: aws.Integer(1),
-		StartTimeFilter: &swf.ExecutionTimeFilter{OldestDate: &aws.UnixTimestamp{time.Unix(0, 0)}},
-		ExecutionFilter: &swf.WorkflowExecutionFilter{
-			WorkflowID: S(id),
-		},
-	})
+	history, err := c.findHistory("GetState", id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	serialized, err := c.f.findSerializedState(history.Events)
 
 	if err != nil {
-		if ae, ok := err.(aws.APIError); ok {
-			log.Printf("component=client fn=GetState at=list-open error-type=%s message=%s", ae.Type, ae.Message)
-		} else {
-			log.Printf("component=client fn=GetState at=list-open error=%s", err)
-		}
+		log.Printf("component=client fn=GetState at=find-serialized-state error=%s", err)
+		return "", nil, err
+	}
+
+	data := c.f.zeroStateData()
+	err = c.f.deserializeStateData(serialized, data)
+	if err != nil {
+		log.Printf("component=client fn=GetState at=deserialize-serialized-state error=%s", err)
 		return "", nil, err
 	}
 
-	if len(open.ExecutionInfos) == 1 {
-		execution = open.ExecutionInfos[0].Execution
-	} else {
+	return serialized.StateName, data, nil
+
+}
+
+// GetErrorState returns the SerializedErrorState of a workflow that is in an error state, or nil if it is not.
+func (c *client) GetErrorState(id string) (*SerializedErrorState, error) {
+	history, err := c.findHistory("GetErrorState", id)
+	if err != nil {
+		return nil, err
+	}
+
+	errorState, err := c.f.findSerializedErrorState(history.Events)
+	if err != nil {
+		log.Printf("component=client fn=GetErrorState at=find-serialized-error-state error=%s", err)
+		return nil, err
+	}
+
+	return errorState, nil
+}
+
+// findHistory returns the history, newest event first, of the open execution of a workflow, or its most recent closed one.
+func (c *client) findHistory(fn string, id string) (*swf.History, error) {
+	execution, err := c.openExecution(fn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if execution == nil {
 		closed, err := c.c.ListClosedWorkflowExecutions(&swf.ListClosedWorkflowExecutionsInput{
 			Domain:          S(c.f.Domain),
 			MaximumPageSize: aws.Integer(1),
@@ -145,17 +179,17 @@ func (c *client) GetState(id string) (string, interface{}, error) {
 
 		if err != nil {
 			if ae, ok := err.(aws.APIError); ok {
-				log.Printf("component=client fn=GetState at=list-closed error-type=%s message=%s", ae.Type, ae.Message)
+				log.Printf("component=client fn=%s at=list-closed error-type=%s message=%s", fn, ae.Type, ae.Message)
 			} else {
-				log.Printf("component=client fn=GetState at=list-closed error=%s", err)
+				log.Printf("component=client fn=%s at=list-closed error=%s", fn, err)
 			}
-			return "", nil, err
+			return nil, err
 		}
 
 		if len(closed.ExecutionInfos) > 0 {
 			execution = closed.ExecutionInfos[0].Execution
 		} else {
-			return "", nil, errors.Trace(fmt.Errorf("workflow not found for id %s", id))
+			return nil, errors.Trace(fmt.Errorf("workflow not found for id %s", id))
 		}
 	}
 
@@ -167,38 +201,37 @@ func (c *client) GetState(id string) (string, interface{}, error) {
 
 	if err != nil {
 		if ae, ok := err.(aws.APIError); ok {
-			log.Printf("component=client fn=GetState at=get-history error-type=%s message=%s", ae.Type, ae.Message)
+			log.Printf("component=client fn=%s at=get-history error-type=%s message=%s", fn, ae.Type, ae.Message)
 		} else {
-			log.Printf("component=client fn=GetState at=get-history error=%s", err)
+			log.Printf("component=client fn=%s at=get-history error=%s", fn, err)
 		}
-		return "", nil, err
+		return nil, err
 	}
 
-	serialized, err := c.f.findSerializedState(history.Events)
-
-	if err != nil {
-		log.Printf("component=client fn=GetState at=find-serialized-state error=%s", err)
-		return "", nil, err
-	}
-
-	data := c.f.zeroStateData()
-	err = c.f.Serializer.Deserialize(serialized.StateData, data)
-	if err != nil {
-		log.Printf("component=client fn=GetState at=deserialize-serialized-state error=%s", err)
-		return "", nil, err
-	}
-
-	return serialized.StateName, data, nil
-
+	return history, nil
 }
 
 func (c *client) Signal(id string, signal string, input interface{}) error {
+	return c.signal(id, nil, signal, input)
+}
+
+// signal sends a signal to the workflow with the id, or to its run with the runID when it is not nil.
+func (c *client) signal(id string, runID aws.StringValue, signal string, input interface{}) error {
 	var serializedInput aws.StringValue
 	if input != nil {
+		registered := c.f.SignalType(signal)
 		switch it := input.(type) {
 		case string:
+			if registered != nil {
+				if err := c.f.Serializer.Deserialize(it, reflect.New(registered).Interface()); err != nil {
+					return errors.Annotatef(err, "input of signal %s is not a %v", signal, registered)
+				}
+			}
 			serializedInput = S(it)
 		default:
+			if registered != nil && indirectType(reflect.TypeOf(input)) != registered {
+				return errors.Errorf("input of signal %s is a %T, not a %v", signal, input, registered)
+			}
 			ser, err := c.f.Serializer.Serialize(input)
 			if err != nil {
 				return errors.Trace(err)
@@ -211,6 +244,7 @@ func (c *client) Signal(id string, signal string, input interface{}) error {
 		SignalName: S(signal),
 		Input:      serializedInput,
 		WorkflowID: S(id),
+		RunID:      runID,
 	})
 }
 
@@ -228,3 +262,103 @@ func (c *client) Start(startTemplate swf.StartWorkflowExecutionInput, id string,
 	startTemplate.Input = serializedInput
 	return c.c.StartWorkflowExecution(&startTemplate)
 }
+
+// StartIfAbsent starts a workflow with the id, unless an execution with the id is open. It returns the run of the started or open
+// execution, and true if it started it.
+func (c *client) StartIfAbsent(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (*swf.Run, bool, error) {
+	for attempt := 1; attempt <= MaxStartAttempts; attempt++ {
+		run, err := c.Start(startTemplate, id, input)
+		if err == nil {
+			return run, true, nil
+		}
+		if !isAPIError(err, ErrorTypeWorkflowExecutionAlreadyStartedFault) {
+			return nil, false, err
+		}
+		execution, err := c.openExecution("StartIfAbsent", id)
+		if err != nil {
+			return nil, false, err
+		}
+		if execution != nil {
+			return &swf.Run{RunID: execution.RunID}, false, nil
+		}
+		log.Printf("component=client fn=StartIfAbsent at=closed-before-found workflow-id=%s attempt=%d", id, attempt)
+	}
+	return nil, false, errors.Errorf("workflow %s kept closing before it was found, after %d attempts", id, MaxStartAttempts)
+}
+
+// StartOrSignal starts a workflow with the id, or if an execution with the id is open, sends it the signal.
+// It returns the run of the started or signaled execution, and true if it started it.
+func (c *client) StartOrSignal(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}, signal string, signalInput interface{}) (*swf.Run, bool, error) {
+	for attempt := 1; attempt <= MaxStartAttempts; attempt++ {
+		run, started, err := c.StartIfAbsent(startTemplate, id, input)
+		if err != nil || started {
+			return run, started, err
+		}
+		err = c.signal(id, run.RunID, signal, signalInput)
+		if err == nil {
+			return run, false, nil
+		}
+		if !isAPIError(err, ErrorTypeUnknownResourceFault) {
+			return nil, false, err
+		}
+		log.Printf("component=client fn=StartOrSignal at=closed-before-signaled workflow-id=%s attempt=%d", id, attempt)
+	}
+	return nil, false, errors.Errorf("workflow %s kept closing before it was signaled, after %d attempts", id, MaxStartAttempts)
+}
+
+// ClosedSince returns the most recent closed execution of a workflow with the id that was started since a time, or nil if there is none.
+func (c *client) ClosedSince(id string, since time.Time) (*swf.WorkflowExecution, error) {
+	closed, err := c.c.ListClosedWorkflowExecutions(&swf.ListClosedWorkflowExecutionsInput{
+		Domain:          S(c.f.Domain),
+		MaximumPageSize: aws.Integer(1),
+		StartTimeFilter: &swf.ExecutionTimeFilter{OldestDate: &aws.UnixTimestamp{since}},
+		ExecutionFilter: &swf.WorkflowExecutionFilter{
+			WorkflowID: S(id),
+		},
+	})
+
+	if err != nil {
+		if ae, ok := err.(aws.APIError); ok {
+			log.Printf("component=client fn=ClosedSince at=list-closed error-type=%s message=%s", ae.Type, ae.Message)
+		} else {
+			log.Printf("component=client fn=ClosedSince at=list-closed error=%s", err)
+		}
+		return nil, err
+	}
+
+	if len(closed.ExecutionInfos) == 0 {
+		return nil, nil
+	}
+	return closed.ExecutionInfos[0].Execution, nil
+}
+
+// openExecution returns the open execution of a workflow, or nil if there is none.
+func (c *client) openExecution(fn string, id string) (*swf.WorkflowExecution, error) {
+	open, err := c.c.ListOpenWorkflowExecutions(&swf.ListOpenWorkflowExecutionsInput{
+		Domain:          S(c.f.Domain),
+		MaximumPageSize: aws.Integer(1),
+		StartTimeFilter: &swf.ExecutionTimeFilter{OldestDate: &aws.UnixTimestamp{time.Unix(0, 0)}},
+		ExecutionFilter: &swf.WorkflowExecutionFilter{
+			WorkflowID: S(id),
+		},
+	})
+
+	if err != nil {
+		if ae, ok := err.(aws.APIError); ok {
+			log.Printf("component=client fn=%s at=list-open error-type=%s message=%s", fn, ae.Type, ae.Message)
+		} else {
+			log.Printf("component=client fn=%s at=list-open error=%s", fn, err)
+		}
+		return nil, err
+	}
+
+	if len(open.ExecutionInfos) == 0 {
+		return nil, nil
+	}
+	return open.ExecutionInfos[0].Execution, nil
+}
+
+func isAPIError(err error, errorType string) bool {
+	ae, ok := errors.Cause(err).(aws.APIError)
+	return ok && ae.Type == errorType
+}
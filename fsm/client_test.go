@@ -1,6 +1,7 @@
 package fsm
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/swf"
 	"github.com/sclasen/swfsm/migrator"
+	. "github.com/sclasen/swfsm/sugar"
 )
 
 func TestClient(t *testing.T) {
@@ -54,7 +56,7 @@ func TestClient(t *testing.T) {
 		Name:             "test-fsm",
 		DataType:         TestData{},
 		Serializer:       JSONStateSerializer{},
-		systemSerializer: JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
 		allowPanics:      false,
 	}
 
@@ -124,7 +126,7 @@ func TestStringDoesntSerialize(t *testing.T) {
 		Name:             "test-fsm",
 		DataType:         TestData{},
 		Serializer:       JSONStateSerializer{},
-		systemSerializer: JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
 		allowPanics:      false,
 	}
 
@@ -140,6 +142,201 @@ func TestStringDoesntSerialize(t *testing.T) {
 
 }
 
+func TestSignalChecksRegisteredType(t *testing.T) {
+	fsm := &FSM{
+		Domain:           "client-test",
+		Name:             "test-fsm",
+		DataType:         TestData{},
+		Serializer:       JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
+	}
+	fsm.AddSignal("typed", TestingType{})
+	mock := &MockSignalSWF{SWF: &swf.SWF{}}
+	fsmClient := NewFSMClient(fsm, mock)
+
+	if err := fsmClient.Signal("wf", "typed", &TestData{}); err == nil {
+		t.Fatal("expected input of the wrong type to be refused")
+	}
+	if err := fsmClient.Signal("wf", "typed", "not json"); err == nil {
+		t.Fatal("expected serialized input that does not deserialize to be refused")
+	}
+	if len(mock.Inputs) != 0 {
+		t.Fatal("expected refused signals not to be sent", mock.Inputs)
+	}
+
+	for _, input := range []interface{}{&TestingType{Field: "a"}, TestingType{Field: "a"}, `{"Field":"a"}`} {
+		if err := fsmClient.Signal("wf", "typed", input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsmClient.Signal("wf", "untyped", &TestData{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.Inputs) != 4 || strings.TrimSpace(mock.Inputs[0]) != `{"Field":"a"}` {
+		t.Fatal("expected the signals to be sent", mock.Inputs)
+	}
+}
+
+func TestStartIfAbsentAndStartOrSignal(t *testing.T) {
+	fsm := &FSM{
+		Domain:           "client-test",
+		Name:             "test-fsm",
+		DataType:         TestData{},
+		Serializer:       JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
+	}
+	mock := &MockStartOrSignalSWF{SWF: &swf.SWF{}}
+	fsmClient := NewFSMClient(fsm, mock)
+	template := swf.StartWorkflowExecutionInput{WorkflowType: &swf.WorkflowType{Name: S("test"), Version: S("1")}}
+
+	run, started, err := fsmClient.StartIfAbsent(template, "wf", &TestData{})
+	if err != nil || !started || *run.RunID != "run-1" {
+		t.Fatal("expected the workflow to start", run, started, err)
+	}
+	run, started, err = fsmClient.StartIfAbsent(template, "wf", &TestData{})
+	if err != nil || started || *run.RunID != "run-1" {
+		t.Fatal("expected the open run", run, started, err)
+	}
+
+	run, started, err = fsmClient.StartOrSignal(template, "wf", &TestData{}, "more", &TestData{States: []string{"more"}})
+	if err != nil || started || *run.RunID != "run-1" || len(mock.Signals) != 1 || mock.Signals[0] != "run-1" {
+		t.Fatal("expected the open run to be signaled", run, started, err, mock.Signals)
+	}
+
+	//the run closes after the start is refused, before it is found
+	mock.CloseOnStart = true
+	run, started, err = fsmClient.StartIfAbsent(template, "wf", &TestData{})
+	if err != nil || !started || *run.RunID != "run-2" {
+		t.Fatal("expected a new run to start", run, started, err)
+	}
+
+	//the run closes after it is found, before it is signaled
+	mock.CloseOnSignal = true
+	run, started, err = fsmClient.StartOrSignal(template, "wf", &TestData{}, "more", nil)
+	if err != nil || !started || *run.RunID != "run-3" {
+		t.Fatal("expected a new run to start", run, started, err)
+	}
+
+	mock.StartErr = fmt.Errorf("boom")
+	mock.Open = nil
+	if _, _, err := fsmClient.StartOrSignal(template, "wf", nil, "more", nil); err == nil {
+		t.Fatal("expected other errors to be returned")
+	}
+}
+
+func TestGetErrorState(t *testing.T) {
+	fsm := &FSM{
+		Domain:           "client-test",
+		Name:             "test-fsm",
+		DataType:         TestData{},
+		Serializer:       JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
+	}
+	marker := func(id int, name string, details interface{}) swf.HistoryEvent {
+		return swf.HistoryEvent{
+			EventID:   aws.Long(int64(id)),
+			EventType: aws.String(swf.EventTypeMarkerRecorded),
+			MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+				MarkerName: aws.String(name),
+				Details:    aws.String(fsm.Serialize(details)),
+			},
+		}
+	}
+	mock := &MockHistorySWF{SWF: &swf.SWF{}}
+	fsmClient := NewFSMClient(fsm, mock)
+
+	mock.Events = []swf.HistoryEvent{
+		marker(3, ErrorMarker, &SerializedErrorState{ErrorMessage: "boom", StateName: "working", Attempts: 1}),
+		marker(2, StateMarker, &SerializedState{StateName: "working"}),
+	}
+	errorState, err := fsmClient.GetErrorState("wf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errorState == nil || errorState.ErrorMessage != "boom" || errorState.StateName != "working" {
+		t.Fatal("expected the error state", errorState)
+	}
+
+	mock.Events = append([]swf.HistoryEvent{marker(4, StateMarker, &SerializedState{StateName: "working"})}, mock.Events...)
+	errorState, err = fsmClient.GetErrorState("wf")
+	if err != nil || errorState != nil {
+		t.Fatal("expected no error state once the workflow recovered", errorState, err)
+	}
+}
+
+type MockHistorySWF struct {
+	*swf.SWF
+	Events []swf.HistoryEvent
+}
+
+func (m *MockHistorySWF) ListOpenWorkflowExecutions(req *swf.ListOpenWorkflowExecutionsInput) (*swf.WorkflowExecutionInfos, error) {
+	return &swf.WorkflowExecutionInfos{
+		ExecutionInfos: []swf.WorkflowExecutionInfo{
+			swf.WorkflowExecutionInfo{Execution: &swf.WorkflowExecution{WorkflowID: req.ExecutionFilter.WorkflowID, RunID: aws.String("run")}},
+		},
+	}, nil
+}
+
+func (m *MockHistorySWF) GetWorkflowExecutionHistory(req *swf.GetWorkflowExecutionHistoryInput) (*swf.History, error) {
+	return &swf.History{Events: m.Events}, nil
+}
+
+type MockStartOrSignalSWF struct {
+	*swf.SWF
+	Open          *swf.WorkflowExecution
+	Runs          int
+	Signals       []string
+	CloseOnStart  bool
+	CloseOnSignal bool
+	StartErr      error
+}
+
+func (m *MockStartOrSignalSWF) StartWorkflowExecution(req *swf.StartWorkflowExecutionInput) (*swf.Run, error) {
+	if m.StartErr != nil {
+		return nil, m.StartErr
+	}
+	if m.Open != nil {
+		if m.CloseOnStart {
+			m.CloseOnStart = false
+			m.Open = nil
+		}
+		return nil, aws.APIError{Type: ErrorTypeWorkflowExecutionAlreadyStartedFault}
+	}
+	m.Runs++
+	m.Open = &swf.WorkflowExecution{WorkflowID: req.WorkflowID, RunID: S(fmt.Sprintf("run-%d", m.Runs))}
+	return &swf.Run{RunID: m.Open.RunID}, nil
+}
+
+func (m *MockStartOrSignalSWF) ListOpenWorkflowExecutions(req *swf.ListOpenWorkflowExecutionsInput) (*swf.WorkflowExecutionInfos, error) {
+	infos := &swf.WorkflowExecutionInfos{}
+	if m.Open != nil {
+		infos.ExecutionInfos = append(infos.ExecutionInfos, swf.WorkflowExecutionInfo{Execution: m.Open})
+	}
+	return infos, nil
+}
+
+func (m *MockStartOrSignalSWF) SignalWorkflowExecution(req *swf.SignalWorkflowExecutionInput) error {
+	if m.CloseOnSignal {
+		m.CloseOnSignal = false
+		m.Open = nil
+	}
+	if m.Open == nil || *m.Open.RunID != *req.RunID {
+		return aws.APIError{Type: ErrorTypeUnknownResourceFault}
+	}
+	m.Signals = append(m.Signals, *req.RunID)
+	return nil
+}
+
+type MockSignalSWF struct {
+	*swf.SWF
+	Inputs []string
+}
+
+func (m *MockSignalSWF) SignalWorkflowExecution(req *swf.SignalWorkflowExecutionInput) error {
+	m.Inputs = append(m.Inputs, *req.Input)
+	return nil
+}
+
 type MockSWF struct {
 	t *testing.T
 	*swf.SWF
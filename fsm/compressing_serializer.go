@@ -0,0 +1,67 @@
+package fsm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// compressedPrefix marks a gzipped and base64 encoded payload. It can not start json or base64, so uncompressed payloads are read as before.
+const compressedPrefix = "gz:"
+
+// CompressingStateSerializer is a StateSerializer that wraps another StateSerializer, and gzips and base64 encodes
+// its output when it is larger than Threshold bytes. Payloads smaller than Threshold are left as they are,
+// and Deserialize reads both, so it can be put in front of the Serializer of an FSM with open workflows.
+//
+// It can wrap the FSM.Serializer, the FSM.SystemSerializer or both.
+type CompressingStateSerializer struct {
+	Serializer StateSerializer
+	Threshold  int
+}
+
+// Serialize serializes with the wrapped StateSerializer, compressing the result if it is over the Threshold.
+func (c CompressingStateSerializer) Serialize(state interface{}) (string, error) {
+	serialized, err := c.Serializer.Serialize(state)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(serialized) <= c.Threshold {
+		return serialized, nil
+	}
+
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(serialized)); err != nil {
+		return "", errors.Trace(err)
+	}
+	if err := w.Close(); err != nil {
+		return "", errors.Trace(err)
+	}
+	return compressedPrefix + base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// Deserialize decompresses the serialized string if needed, and deserializes it with the wrapped StateSerializer.
+func (c CompressingStateSerializer) Deserialize(serialized string, state interface{}) error {
+	if !strings.HasPrefix(serialized, compressedPrefix) {
+		return c.Serializer.Deserialize(serialized, state)
+	}
+
+	bin, err := base64.StdEncoding.DecodeString(serialized[len(compressedPrefix):])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(bin))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer r.Close()
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return c.Serializer.Deserialize(string(decompressed), state)
+}
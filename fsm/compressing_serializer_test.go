@@ -0,0 +1,52 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressingStateSerializer(t *testing.T) {
+	ser := CompressingStateSerializer{Serializer: JSONStateSerializer{}, Threshold: 100}
+
+	small := &TestData{States: []string{"a"}}
+	serialized, err := ser.Serialize(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(serialized, compressedPrefix) {
+		t.Fatal("expected data under the threshold to be left uncompressed", serialized)
+	}
+
+	large := &TestData{}
+	for i := 0; i < 100; i++ {
+		large.States = append(large.States, "some-repetitive-state")
+	}
+	serialized, err = ser.Serialize(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, _ := JSONStateSerializer{}.Serialize(large)
+	if !strings.HasPrefix(serialized, compressedPrefix) || len(serialized) >= len(uncompressed) {
+		t.Fatal("expected data over the threshold to be compressed", serialized)
+	}
+
+	read := &TestData{}
+	if err := ser.Deserialize(serialized, read); err != nil {
+		t.Fatal(err)
+	}
+	if len(read.States) != 100 {
+		t.Fatal(read)
+	}
+
+	read = &TestData{}
+	if err := ser.Deserialize(uncompressed, read); err != nil {
+		t.Fatal(err)
+	}
+	if len(read.States) != 100 {
+		t.Fatal(read)
+	}
+
+	if err := ser.Deserialize(compressedPrefix+"not-base64!", read); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -18,6 +18,14 @@ type EventCorrelator struct {
 	Signals          map[string]*SignalInfo   //schedueledEventId -> info
 	SignalAttempts   map[string]int           //? workflowID + signalName -> attempts
 	Timers           map[string]*TimerInfo    //startedEventID -> info
+	Versions         map[string]int           `json:",omitempty"` //changeID -> version, see FSMContext.Version
+	SideEffects      map[string]string        `json:",omitempty"` //name@eventID -> serialized result, see FSMContext.SideEffect
+	Stashed          []swf.HistoryEvent       `json:",omitempty"` //oldest first, see FSMContext.Stash
+	Close            *CloseInfo               `json:",omitempty"` //the close decision of the last decision task, see FSM.MaxCloseDecisionRetries
+	Children         map[string]*ChildInfo    `json:",omitempty"` //initiatedEventID -> info
+	Continuing       bool                     `json:",omitempty"` //set once ManagedContinuations signals the workflow to continue
+	Groups           map[string]*GroupInfo    `json:",omitempty"` //groupID -> members, see FSMContext.ScheduleGroup
+	Fired            map[string]bool          `json:",omitempty"` //ids of the Once deciders that have fired
 }
 
 // ActivityInfo holds the ActivityID and ActivityType for an activity
@@ -32,10 +40,17 @@ type SignalInfo struct {
 	WorkflowID string
 }
 
+// ChildInfo holds the WorkflowID and WorkflowType of a child workflow that was started and has not closed.
+type ChildInfo struct {
+	WorkflowID string
+	*swf.WorkflowType
+}
+
 //TimerInfo holds the Control data from a Timer
 type TimerInfo struct {
-	Control string
-	TimerID string
+	Control  string
+	TimerID  string
+	FireTime int64 `json:",omitempty"` //unix seconds the timer fires at, see FSMContext.ContinueWorkflowDecision
 }
 
 // Track will add or remove entries based on the EventType.
@@ -64,16 +79,32 @@ func (a *EventCorrelator) Correlate(h swf.HistoryEvent) {
 		}
 	}
 
+	if a.nilSafeEq(h.EventType, swf.EventTypeStartChildWorkflowExecutionInitiated) {
+		if a.Children == nil {
+			a.Children = make(map[string]*ChildInfo)
+		}
+		a.Children[a.key(h.EventID)] = &ChildInfo{
+			WorkflowID:   *h.StartChildWorkflowExecutionInitiatedEventAttributes.WorkflowID,
+			WorkflowType: h.StartChildWorkflowExecutionInitiatedEventAttributes.WorkflowType,
+		}
+	}
+
 	if a.nilSafeEq(h.EventType, swf.EventTypeTimerStarted) {
 		control := ""
 		if h.TimerStartedEventAttributes.Control != nil {
 			control = *h.TimerStartedEventAttributes.Control
 		}
 
-		a.Timers[a.key(h.EventID)] = &TimerInfo{
+		info := &TimerInfo{
 			Control: control,
 			TimerID: *h.TimerStartedEventAttributes.TimerID,
 		}
+		if h.EventTimestamp != nil && h.TimerStartedEventAttributes.StartToFireTimeout != nil {
+			if seconds, err := strconv.ParseInt(*h.TimerStartedEventAttributes.StartToFireTimeout, 10, 64); err == nil {
+				info.FireTime = h.EventTimestamp.Unix() + seconds
+			}
+		}
+		a.Timers[a.key(h.EventID)] = info
 	}
 }
 
@@ -83,6 +114,7 @@ func (a *EventCorrelator) RemoveCorrelation(h swf.HistoryEvent) {
 	if h.EventType == nil {
 		return
 	}
+	a.recordGroupResult(h)
 	switch *h.EventType {
 	case swf.EventTypeActivityTaskCompleted:
 		delete(a.ActivityAttempts, a.safeActivityID(h))
@@ -108,6 +140,10 @@ func (a *EventCorrelator) RemoveCorrelation(h swf.HistoryEvent) {
 		delete(a.Timers, a.key(h.TimerFiredEventAttributes.StartedEventID))
 	case swf.EventTypeTimerCanceled:
 		delete(a.Timers, a.key(h.TimerCanceledEventAttributes.StartedEventID))
+	case swf.EventTypeChildWorkflowExecutionCompleted, swf.EventTypeChildWorkflowExecutionFailed,
+		swf.EventTypeChildWorkflowExecutionTimedOut, swf.EventTypeChildWorkflowExecutionCanceled,
+		swf.EventTypeChildWorkflowExecutionTerminated, swf.EventTypeStartChildWorkflowExecutionFailed:
+		delete(a.Children, a.getID(h))
 	}
 }
 
@@ -128,6 +164,16 @@ func (a *EventCorrelator) TimerInfo(h swf.HistoryEvent) *TimerInfo {
 	return a.Timers[a.getID(h)]
 }
 
+// TimerOpen returns true if a timer with the timerID has started, and has not fired or been canceled.
+func (a *EventCorrelator) TimerOpen(timerID string) bool {
+	for _, info := range a.Timers {
+		if info.TimerID == timerID {
+			return true
+		}
+	}
+	return false
+}
+
 //AttemptsForActivity returns the number of times a given activity has been attempted.
 //It will return 0 if the activity has never failed, has been canceled, or has been completed successfully
 func (a *EventCorrelator) AttemptsForActivity(info *ActivityInfo) int {
@@ -142,6 +188,83 @@ func (a *EventCorrelator) AttemptsForSignal(signalInfo *SignalInfo) int {
 	return a.SignalAttempts[a.signalIDFromInfo(signalInfo)]
 }
 
+// Version returns the version recorded for a change by FSMContext.Version, and whether one was recorded.
+func (a *EventCorrelator) Version(changeID string) (int, bool) {
+	version, ok := a.Versions[changeID]
+	return version, ok
+}
+
+func (a *EventCorrelator) recordVersion(changeID string, version int) {
+	if a.Versions == nil {
+		a.Versions = make(map[string]int)
+	}
+	a.Versions[changeID] = version
+}
+
+// SideEffect returns the serialized result recorded by FSMContext.SideEffect for a key, and whether one was recorded.
+func (a *EventCorrelator) SideEffect(key string) (string, bool) {
+	result, ok := a.SideEffects[key]
+	return result, ok
+}
+
+func (a *EventCorrelator) recordSideEffect(key string, result string) {
+	if a.SideEffects == nil {
+		a.SideEffects = make(map[string]string)
+	}
+	a.SideEffects[key] = result
+}
+
+// clearSideEffects drops the recorded side effects once the events they were recorded for are processed, and will not be decided again.
+func (a *EventCorrelator) clearSideEffects() {
+	a.SideEffects = nil
+}
+
+// Outstanding returns the number of activities and timers that are still open once h is tracked.
+func (a *EventCorrelator) Outstanding(h swf.HistoryEvent) int {
+	a.checkInit()
+	outstanding := len(a.Activities) + len(a.Timers)
+	if h.EventType == nil {
+		return outstanding
+	}
+	switch *h.EventType {
+	case swf.EventTypeActivityTaskScheduled, swf.EventTypeTimerStarted:
+		outstanding++
+	case swf.EventTypeActivityTaskCompleted, swf.EventTypeActivityTaskFailed,
+		swf.EventTypeActivityTaskTimedOut, swf.EventTypeActivityTaskCanceled:
+		if _, ok := a.Activities[a.getID(h)]; ok {
+			outstanding--
+		}
+	case swf.EventTypeTimerFired, swf.EventTypeTimerCanceled:
+		if _, ok := a.Timers[a.getID(h)]; ok {
+			outstanding--
+		}
+	}
+	return outstanding
+}
+
+// ChildInfo returns the ChildInfo that correlates with a given event, a child workflow closing, or failing to start.
+func (a *EventCorrelator) ChildInfo(h swf.HistoryEvent) *ChildInfo {
+	return a.Children[a.getID(h)]
+}
+
+// stash adds an event to the stash, and drops and returns the oldest stashed event if the stash already holds limit events.
+func (a *EventCorrelator) stash(h swf.HistoryEvent, limit int) *swf.HistoryEvent {
+	var dropped *swf.HistoryEvent
+	if len(a.Stashed) >= limit {
+		dropped = &a.Stashed[0]
+		a.Stashed = a.Stashed[1:]
+	}
+	a.Stashed = append(a.Stashed, h)
+	return dropped
+}
+
+// unstash empties the stash and returns the events it held.
+func (a *EventCorrelator) unstash() []swf.HistoryEvent {
+	stashed := a.Stashed
+	a.Stashed = nil
+	return stashed
+}
+
 func (a *EventCorrelator) checkInit() {
 	if a.Activities == nil {
 		a.Activities = make(map[string]*ActivityInfo)
@@ -194,6 +317,30 @@ func (a *EventCorrelator) getID(h swf.HistoryEvent) (id string) {
 		if h.TimerCanceledEventAttributes != nil {
 			id = a.key(h.TimerCanceledEventAttributes.StartedEventID)
 		}
+	case swf.EventTypeChildWorkflowExecutionCompleted:
+		if h.ChildWorkflowExecutionCompletedEventAttributes != nil {
+			id = a.key(h.ChildWorkflowExecutionCompletedEventAttributes.InitiatedEventID)
+		}
+	case swf.EventTypeChildWorkflowExecutionFailed:
+		if h.ChildWorkflowExecutionFailedEventAttributes != nil {
+			id = a.key(h.ChildWorkflowExecutionFailedEventAttributes.InitiatedEventID)
+		}
+	case swf.EventTypeChildWorkflowExecutionTimedOut:
+		if h.ChildWorkflowExecutionTimedOutEventAttributes != nil {
+			id = a.key(h.ChildWorkflowExecutionTimedOutEventAttributes.InitiatedEventID)
+		}
+	case swf.EventTypeChildWorkflowExecutionCanceled:
+		if h.ChildWorkflowExecutionCanceledEventAttributes != nil {
+			id = a.key(h.ChildWorkflowExecutionCanceledEventAttributes.InitiatedEventID)
+		}
+	case swf.EventTypeChildWorkflowExecutionTerminated:
+		if h.ChildWorkflowExecutionTerminatedEventAttributes != nil {
+			id = a.key(h.ChildWorkflowExecutionTerminatedEventAttributes.InitiatedEventID)
+		}
+	case swf.EventTypeStartChildWorkflowExecutionFailed:
+		if h.StartChildWorkflowExecutionFailedEventAttributes != nil {
+			id = a.key(h.StartChildWorkflowExecutionFailedEventAttributes.InitiatedEventID)
+		}
 
 	}
 	return
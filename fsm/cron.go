@@ -0,0 +1,173 @@
+package fsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// CronSchedule gives the times a Schedule fires at.
+type CronSchedule interface {
+	// Next returns the first time the schedule fires that is after t, or the zero time if it never does.
+	Next(t time.Time) time.Time
+}
+
+// cronDescriptors are the shorthands ParseCron accepts in place of the five fields.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron spec with the five fields minute, hour, day of month, month and day of week.
+// Fields are *, a value, a range like 1-5, or a list of them like 1,15-20, each optionally with a step like */15 or 0-30/10.
+// Days of the week are 0-6 from Sunday, and 7 is Sunday too. When both the day of month and the day of week are set,
+// a day that matches either fires, as in cron. The shorthands @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly,
+// and @every <duration> for a fixed interval, like @every 90m, are accepted too. Times are in the location of the time given to Next.
+func ParseCron(spec string) (CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, errors.Annotatef(err, "bad cron spec %q", spec)
+		}
+		if interval < time.Second {
+			return nil, errors.Errorf("bad cron spec %q, interval must be at least a second", spec)
+		}
+		return everySchedule(interval), nil
+	}
+	if expanded, ok := cronDescriptors[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("bad cron spec %q, expected 5 fields, found %d", spec, len(fields))
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var parsed [5]uint64
+	for i, field := range fields {
+		bits, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, errors.Annotatef(err, "bad cron spec %q", spec)
+		}
+		parsed[i] = bits
+	}
+	c := &cronFields{
+		minutes: parsed[0],
+		hours:   parsed[1],
+		days:    parsed[2],
+		months:  parsed[3],
+		weekday: parsed[4],
+		anyDay:  fields[2] == "*",
+		anyWeek: fields[4] == "*",
+	}
+	//Sunday is 0 and 7
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	return c, nil
+}
+
+// parseCronField parses a field of a cron spec into a bit set of the values it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = s
+			part = part[:i]
+		}
+		from, to := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("bad range %q", part)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			from, to = value, value
+			if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// cronFields is a CronSchedule parsed from the five fields of a cron spec, as bit sets of the values they match.
+type cronFields struct {
+	minutes, hours, days, months, weekday uint64
+	anyDay, anyWeek                       bool
+}
+
+func (c *cronFields) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	//no schedule goes more than a few years without firing, unless it can never fire, like on February 30
+	limit := next.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		if !matches(c.months, int(next.Month())) {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !c.dayMatches(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !matches(c.hours, next.Hour()) {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+		if !matches(c.minutes, next.Minute()) {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
+
+func (c *cronFields) dayMatches(t time.Time) bool {
+	day := matches(c.days, t.Day())
+	weekday := matches(c.weekday, int(t.Weekday()))
+	if c.anyDay || c.anyWeek {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func matches(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+// everySchedule is a CronSchedule that fires at a fixed interval.
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
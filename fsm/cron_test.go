@@ -0,0 +1,59 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	//2015-06-10 is a Wednesday
+	cases := []struct {
+		spec string
+		from string
+		next string
+	}{
+		{"* * * * *", "2015-06-10 10:30", "2015-06-10 10:31"},
+		{"@hourly", "2015-06-10 10:30", "2015-06-10 11:00"},
+		{"@daily", "2015-06-10 10:30", "2015-06-11 00:00"},
+		{"*/15 * * * *", "2015-06-10 10:30", "2015-06-10 10:45"},
+		{"0 9-17/4 * * *", "2015-06-10 10:30", "2015-06-10 13:00"},
+		{"30 2 * * *", "2015-06-10 10:30", "2015-06-11 02:30"},
+		{"0 0 1 * *", "2015-06-10 10:30", "2015-07-01 00:00"},
+		{"0 0 31 * *", "2015-06-10 10:30", "2015-07-31 00:00"},
+		{"0 12 * * 1,5", "2015-06-10 10:30", "2015-06-12 12:00"},
+		{"0 12 * * 7", "2015-06-10 10:30", "2015-06-14 12:00"},
+		{"0 0 29 2 *", "2015-06-10 10:30", "2016-02-29 00:00"},
+		{"0 0 15 * 0", "2015-06-10 10:30", "2015-06-14 00:00"},
+		{"@every 90m", "2015-06-10 10:30", "2015-06-10 12:00"},
+	}
+	for _, tc := range cases {
+		cron, err := ParseCron(tc.spec)
+		if err != nil {
+			t.Fatal(tc.spec, err)
+		}
+		if next := cron.Next(at(tc.from)); !next.Equal(at(tc.next)) {
+			t.Fatal("unexpected next time", tc.spec, tc.from, next)
+		}
+	}
+
+	never, err := ParseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := never.Next(at("2015-06-10 10:30")); !next.IsZero() {
+		t.Fatal("expected February 30 to never come", next)
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@every soon", "@every 1ms"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Fatal("expected a bad spec to fail", spec)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package fsm
 import (
 	"fmt"
 	"log"
+	"math"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/swf"
@@ -69,6 +71,15 @@ func DefaultDecider() Decider {
 	}
 }
 
+//StashDecider is a 'catch-all' decider that stashes the unhandled event, so it is replayed when the workflow changes state.
+//Use it in place of DefaultDecider in states that may receive events meant for a later state.
+func StashDecider() Decider {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		logf(ctx, "at=stash-event event=%s", LS(h.EventType))
+		return ctx.Stash(data)
+	}
+}
+
 //DecisionFunc is a building block for composable deciders that returns a decision.
 type DecisionFunc func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) swf.Decision
 
@@ -154,6 +165,56 @@ func (m marshalledFunc) predicateFunc(data interface{}) bool {
 	return m.v.Call([]reflect.Value{reflect.ValueOf(data)})[0].Interface().(bool)
 }
 
+func (m marshalledFunc) payloadDecider(f *FSMContext, h swf.HistoryEvent, data interface{}, payload reflect.Value) Outcome {
+	ret := m.v.Call([]reflect.Value{reflect.ValueOf(f), reflect.ValueOf(h), reflect.ValueOf(data), payload})[0]
+	return ret.Interface().(Outcome)
+}
+
+// payloadCheck verifies that typedFunc is a func(*FSMContext, swf.HistoryEvent, *T, *P) Outcome, and returns the type of *P.
+func payloadCheck(typedFunc interface{}) reflect.Type {
+	t := reflect.TypeOf(typedFunc)
+	if t == nil || reflect.Func != t.Kind() {
+		panic(fmt.Sprintf("kind was %v, not Func", t))
+	}
+	if t.NumIn() != 4 {
+		panic(fmt.Sprintf("input arity was %v, not 4", t.NumIn()))
+	}
+	for i := 2; i < 4; i++ {
+		if t.In(i).Kind() != reflect.Ptr {
+			panic(fmt.Sprintf("type of argument %v was %v, not a pointer", i, t.In(i)))
+		}
+	}
+	typeCheck(typedFunc, []string{"*fsm.FSMContext", "swf.HistoryEvent", t.In(2).String(), t.In(3).String()}, []string{"fsm.Outcome"})
+	return t.In(3)
+}
+
+// payloadValue deserializes the serialized payload of an event into a new value of payloadType, or returns a nil value of payloadType
+// when the payload is empty.
+func payloadValue(ctx *FSMContext, serialized *string, payloadType reflect.Type) reflect.Value {
+	if serialized == nil || *serialized == "" {
+		return reflect.Zero(payloadType)
+	}
+	payload := reflect.New(payloadType.Elem())
+	ctx.Deserialize(*serialized, payload.Interface())
+	return payload
+}
+
+// checkSignalType panics if a payload type other than payloadType is registered for the signal with FSM.AddSignal.
+func checkSignalType(ctx *FSMContext, signalName string, payloadType reflect.Type) {
+	if fsm := ctx.fsm(); fsm != nil {
+		if registered := fsm.SignalType(signalName); registered != nil && registered != payloadType.Elem() {
+			panic(fmt.Sprintf("payload of signal %s is registered as %v, not %v", signalName, registered, payloadType))
+		}
+	}
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	if t != nil && t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
 func typeCheck(typedFunc interface{}, in []string, out []string) {
 	t := reflect.TypeOf(typedFunc)
 	if reflect.Func != t.Kind() {
@@ -248,6 +309,27 @@ func OnSignalReceived(signalName string, deciders ...Decider) Decider {
 	return OnSignalsReceived([]string{signalName}, deciders...)
 }
 
+// OnSignal builds a decider that fires when a matching signal is received, from a func(*FSMContext, swf.HistoryEvent, *T, *P) Outcome,
+// where T is the type of your FSM stateData and P the type of the signal payload. The payload is deserialized into a new *P,
+// which is nil when the signal has no input. The typing is checked at construction time, and if a payload type is registered
+// for the signal with FSM.AddSignal, P is checked against it when the signal is received.
+func OnSignal(signalName string, decider interface{}) Decider {
+	payloadType := payloadCheck(decider)
+	typed := marshalledFunc{reflect.ValueOf(decider)}
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		switch *h.EventType {
+		case swf.EventTypeWorkflowExecutionSignaled:
+			if *h.WorkflowExecutionSignaledEventAttributes.SignalName == signalName {
+				checkSignalType(ctx, signalName, payloadType)
+				logf(ctx, "at=on-signal")
+				payload := payloadValue(ctx, h.WorkflowExecutionSignaledEventAttributes.Input, payloadType)
+				return typed.payloadDecider(ctx, h, data, payload)
+			}
+		}
+		return ctx.Pass()
+	}
+}
+
 // OnSignalSent builds a composed decider that fires on when a matching signal is recieved.
 func OnSignalSent(signalName string, deciders ...Decider) Decider {
 	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
@@ -321,6 +403,26 @@ func OnActivityCompleted(activityName string, deciders ...Decider) Decider {
 	}, deciders...)
 }
 
+// OnActivityResult builds a decider that fires when a matching activity completes, from a func(*FSMContext, swf.HistoryEvent, *T, *R) Outcome,
+// where T is the type of your FSM stateData and R the type of the activity result. The result is deserialized into a new *R,
+// which is nil when the activity completed without one. The typing is checked at construction time.
+func OnActivityResult(activityName string, decider interface{}) Decider {
+	resultType := payloadCheck(decider)
+	typed := marshalledFunc{reflect.ValueOf(decider)}
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		switch *h.EventType {
+		case swf.EventTypeActivityTaskCompleted:
+			info := ctx.ActivityInfo(h)
+			if info != nil && *info.Name == activityName {
+				logf(ctx, "at=on-activity-result")
+				result := payloadValue(ctx, h.ActivityTaskCompletedEventAttributes.Result, resultType)
+				return typed.payloadDecider(ctx, h, data, result)
+			}
+		}
+		return ctx.Pass()
+	}
+}
+
 // OnActivityFailed builds a composed decider that fires when a matching activity fails.
 func OnActivityFailed(activityName string, deciders ...Decider) Decider {
 	return OnActivityEvents(activityName, []string{
@@ -406,62 +508,78 @@ func Stay() Decider {
 	}
 }
 
+// ContinuationPolicy configures when ManagedContinuationsWithPolicy continues a workflow. Triggers that are 0 are not used.
+type ContinuationPolicy struct {
+	// MaxEvents continues the workflow once the ID of an event is larger, so its history has more events.
+	MaxEvents int
+	// MaxHistoryBytes continues the workflow once its history is larger, see FSMContext.HistoryBytes.
+	MaxHistoryBytes int
+	// MaxAge continues the workflow once the current run is older, see FSMContext.RunAge.
+	MaxAge time.Duration
+	// RetrySeconds is how long to wait before checking again, when the workflow has work outstanding.
+	RetrySeconds int
+	// Compact, if set, is called with the state data just before the workflow continues, so it can drop what the continued run does not need.
+	Compact func(ctx *FSMContext, data interface{})
+}
+
+// due is true if the workflow has reached one of the triggers of the policy at the event being decided.
+func (p ContinuationPolicy) due(ctx *FSMContext, h swf.HistoryEvent) bool {
+	return (p.MaxEvents > 0 && *h.EventID > int64(p.MaxEvents)) ||
+		(p.MaxAge > 0 && ctx.RunAge() > p.MaxAge) ||
+		(p.MaxHistoryBytes > 0 && ctx.HistoryBytes() > p.MaxHistoryBytes)
+}
+
 //ManagedContinuations is a composable decider that will handle most of the mechanics of autmoatically continuing workflows.
-//todo, does it ever happen that we would have a decision task that previous deciders would have created a decision that
-//breaks continuation? i.e. you get decision task that has a history containing 2 signals, etc.
-//lets assume not till we find otherwise. If we are wrong, managedcontinuations probably cant happen in userspace.
-// If there are no activities present in the tracker, it will continueAsNew the workflow in response
-// to a FSM.ContinueWorkflow timer or signal. If there are activities present in the tracker, it will
-// set a new FSM.ContinueWorkflow timer, that fires in timerRetrySeconds.
-// It will also signal the workflow to continue when the workflow history grows beyond the
-// configured historySize.
-// this should be last in your decider stack, as it will signal in response to *any* event that
-// has an id > historySize
+// It signals the workflow to continue when the workflow history grows beyond the configured historySize,
+// and waits timerRetrySeconds between checks for outstanding work. See ManagedContinuationsWithPolicy.
 func ManagedContinuations(historySize int, timerRetrySeconds int) Decider {
-	handleContinuationTimer := func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
-		if *h.EventType == swf.EventTypeTimerFired && *h.TimerFiredEventAttributes.TimerID == ContinueTimer {
-			if len(ctx.ActivitiesInfo()) == 0 {
-				decisions := append(ctx.EmptyDecisions(), ctx.ContinueWorkflowDecision(ctx.State, data))
-				return ctx.Stay(data, decisions)
-			}
+	return ManagedContinuationsWithPolicy(ContinuationPolicy{MaxEvents: historySize, RetrySeconds: timerRetrySeconds})
+}
+
+// ManagedContinuationsWithPolicy is a composable decider that continues workflows when they reach a trigger of the policy.
+// When a trigger is reached it signals the workflow with FSM.ContinueWorkflow, once per run. In response to that signal,
+// or to the FSM.ContinueWorkflow timer, it continues the workflow if there are no activities, outbound signals or child workflows
+// outstanding. Otherwise it starts a FSM.ContinueWorkflow timer to check again in RetrySeconds.
+// Open timers do not hold up the continuation, they are started again in the continued run, see FSMContext.ContinueWorkflowDecision.
+// this should be last in your decider stack, as it will signal in response to *any* event once a trigger is reached.
+func ManagedContinuationsWithPolicy(policy ContinuationPolicy) Decider {
+	continueOrWait := func(ctx *FSMContext, data interface{}) Outcome {
+		if outstanding := continuationOutstanding(ctx); outstanding > 0 {
+			logf(ctx, "at=continue-waiting outstanding=%d retry-seconds=%d", outstanding, policy.RetrySeconds)
 			d := swf.Decision{
 				DecisionType: aws.String(swf.DecisionTypeStartTimer),
 				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
-					StartToFireTimeout: aws.String(strconv.Itoa(timerRetrySeconds)),
+					StartToFireTimeout: aws.String(strconv.Itoa(policy.RetrySeconds)),
 					TimerID:            aws.String(ContinueTimer),
 				},
 			}
-			decisions := append(ctx.EmptyDecisions(), d)
-			return ctx.Stay(data, decisions)
+			return ctx.Stay(data, append(ctx.EmptyDecisions(), d))
+		}
+		if policy.Compact != nil {
+			policy.Compact(ctx, data)
+		}
+		decisions := append(ctx.EmptyDecisions(), ctx.ContinueWorkflowDecision(ctx.State, data))
+		return ctx.Stay(data, decisions)
+	}
 
+	handleContinuationTimer := func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if *h.EventType == swf.EventTypeTimerFired && *h.TimerFiredEventAttributes.TimerID == ContinueTimer {
+			return continueOrWait(ctx, data)
 		}
 		return ctx.Pass()
 	}
 
 	handleContinuationSignal := func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
 		if *h.EventType == swf.EventTypeWorkflowExecutionSignaled && *h.WorkflowExecutionSignaledEventAttributes.SignalName == ContinueSignal {
-
-			if len(ctx.ActivitiesInfo()) == 0 {
-				decisions := append(ctx.EmptyDecisions(), ctx.ContinueWorkflowDecision(ctx.State, data))
-				return ctx.Stay(data, decisions)
-			}
-
-			d := swf.Decision{
-				DecisionType: aws.String(swf.DecisionTypeStartTimer),
-				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
-					StartToFireTimeout: aws.String(strconv.Itoa(timerRetrySeconds)),
-					TimerID:            aws.String(ContinueTimer),
-				},
-			}
-			decisions := append(ctx.EmptyDecisions(), d)
-			return ctx.Stay(data, decisions)
-
+			return continueOrWait(ctx, data)
 		}
 		return ctx.Pass()
 	}
 
-	signalContinuationWhenHistoryLarge := func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
-		if *h.EventID > int64(historySize) {
+	signalContinuationWhenDue := func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if !ctx.eventCorrelator.Continuing && policy.due(ctx, h) {
+			logf(ctx, "at=continue-requested event-id=%d", *h.EventID)
+			ctx.eventCorrelator.Continuing = true
 			d := swf.Decision{
 				DecisionType: aws.String(swf.DecisionTypeSignalExternalWorkflowExecution),
 				SignalExternalWorkflowExecutionDecisionAttributes: &swf.SignalExternalWorkflowExecutionDecisionAttributes{
@@ -479,11 +597,202 @@ func ManagedContinuations(historySize int, timerRetrySeconds int) Decider {
 	return NewComposedDecider(
 		handleContinuationTimer,
 		handleContinuationSignal,
-		signalContinuationWhenHistoryLarge,
+		signalContinuationWhenDue,
 	)
 
 }
 
+// AwaitSignal builds a decider that waits for a signal with signalName, for at most timeout.
+// It starts a FSM.Await.<signalName> timer on the first event it decides while the timer is not open, or when the workflow enters the state
+// if StartAwait is its OnEnter. When the signal is received first the timer is canceled and onSignal is called, and when the timer fires first
+// onTimeout is called. Awaits for different signals have their own timers, so they can run at the same time, see AwaitSignalWithID
+// for several awaits on the same signal.
+// onSignal and onTimeout usually move the workflow to another state, if they do not the await starts again on the next event.
+// Use CancelAwait as the OnExit of the state if other events can move the workflow out of it, so the timer does not outlive the state.
+func AwaitSignal(signalName string, timeout time.Duration, onSignal Decider, onTimeout Decider) Decider {
+	return AwaitSignalWithID(signalName, "", timeout, onSignal, onTimeout)
+}
+
+// AwaitSignalWithID builds an AwaitSignal with a FSM.Await.<signalName>.<id> timer, so awaits on the same signal with different ids
+// can run at the same time. Use StartAwaitWithID and CancelAwaitWithID with the same id.
+func AwaitSignalWithID(signalName string, id string, timeout time.Duration, onSignal Decider, onTimeout Decider) Decider {
+	timerID := AwaitTimerIDWithID(signalName, id)
+	signaled := OnSignalReceived(signalName, CancelAwaitWithID(signalName, id), onSignal)
+	timedOut := OnTimerFired(timerID, onTimeout)
+	start := StartAwaitWithID(signalName, id, timeout)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		switch *h.EventType {
+		case swf.EventTypeWorkflowExecutionSignaled:
+			if *h.WorkflowExecutionSignaledEventAttributes.SignalName == signalName {
+				return signaled(ctx, h, data)
+			}
+		case swf.EventTypeTimerFired:
+			if *h.TimerFiredEventAttributes.TimerID == timerID {
+				return timedOut(ctx, h, data)
+			}
+		case swf.EventTypeTimerStarted:
+			if *h.TimerStartedEventAttributes.TimerID == timerID {
+				return ctx.Pass()
+			}
+		}
+		return start(ctx, h, data)
+	}
+}
+
+// AwaitTimerID returns the ID of the timer AwaitSignal starts for the signal with signalName.
+func AwaitTimerID(signalName string) string {
+	return AwaitTimerIDWithID(signalName, "")
+}
+
+// AwaitTimerIDWithID returns the ID of the timer AwaitSignalWithID starts for the signal with signalName and id.
+// The id is left out when it is empty.
+func AwaitTimerIDWithID(signalName string, id string) string {
+	if id == "" {
+		return AwaitTimer + "." + signalName
+	}
+	return AwaitTimer + "." + signalName + "." + id
+}
+
+// StartAwait builds a decider that starts the timer of an AwaitSignal for signalName, unless it is already open
+// or started in the same decision task, as it is when a continued run starts it again.
+// It is meant to be the OnEnter of the state AwaitSignal decides, so the timeout counts from when the workflow enters the state.
+func StartAwait(signalName string, timeout time.Duration) Decider {
+	return StartAwaitWithID(signalName, "", timeout)
+}
+
+// StartAwaitWithID is StartAwait for the AwaitSignalWithID with id.
+func StartAwaitWithID(signalName string, id string, timeout time.Duration) Decider {
+	timerID := AwaitTimerIDWithID(signalName, id)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if ctx.timerPending(timerID) {
+			return ctx.Pass()
+		}
+		logf(ctx, "at=start-await timer=%s timeout=%s", timerID, timeout)
+		ctx.timerStarted(timerID)
+		d := swf.Decision{
+			DecisionType: aws.String(swf.DecisionTypeStartTimer),
+			StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+				StartToFireTimeout: aws.String(strconv.Itoa(int(timeout.Seconds()))),
+				TimerID:            aws.String(timerID),
+			},
+		}
+		return Outcome{State: "", Data: data, Decisions: append(ctx.EmptyDecisions(), d)}
+	}
+}
+
+// CancelAwait builds a decider that cancels the timer of an AwaitSignal for signalName, if it is open.
+// A timer started in the same decision task is canceled after the decision that starts it, so it does not fire.
+func CancelAwait(signalName string) Decider {
+	return CancelAwaitWithID(signalName, "")
+}
+
+// CancelAwaitWithID is CancelAwait for the AwaitSignalWithID with id.
+func CancelAwaitWithID(signalName string, id string) Decider {
+	timerID := AwaitTimerIDWithID(signalName, id)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if !ctx.timerPending(timerID) {
+			return ctx.Pass()
+		}
+		logf(ctx, "at=cancel-await timer=%s", timerID)
+		delete(ctx.startedTimers, timerID)
+		d := swf.Decision{
+			DecisionType:                  aws.String(swf.DecisionTypeCancelTimer),
+			CancelTimerDecisionAttributes: &swf.CancelTimerDecisionAttributes{TimerID: aws.String(timerID)},
+		}
+		return Outcome{State: "", Data: data, Decisions: append(ctx.EmptyDecisions(), d)}
+	}
+}
+
+// Schedule builds a decider that keeps a FSM.Schedule.<name> timer running that fires at the times of the cron spec, see ParseCron.
+// It starts the timer on the first event it decides while the timer is not open, for the next time of the spec after the event,
+// and starts it again for the following time when it fires. Use OnScheduleFired to react to it, after Schedule in a composed decider.
+// The timer is started again in continued runs, see FSMContext.ContinueWorkflowDecision. It panics if the spec does not parse.
+func Schedule(name string, cronSpec string) Decider {
+	cron, err := ParseCron(cronSpec)
+	if err != nil {
+		panic(err)
+	}
+	timerID := ScheduleTimerID(name)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		from := ctx.Now()
+		switch *h.EventType {
+		case swf.EventTypeTimerStarted:
+			if *h.TimerStartedEventAttributes.TimerID == timerID {
+				return ctx.Pass()
+			}
+		case swf.EventTypeTimerFired:
+			if *h.TimerFiredEventAttributes.TimerID != timerID {
+				break
+			}
+			//start from the time the timer was due, so a timer that fires early does not fire twice for the same time
+			if info := ctx.eventCorrelator.TimerInfo(h); info != nil {
+				if due, err := strconv.ParseInt(info.Control, 10, 64); err == nil && time.Unix(due, 0).After(from) {
+					from = time.Unix(due, 0).In(from.Location())
+				}
+			}
+			return scheduleTimer(ctx, name, cron, from, data)
+		}
+		if ctx.timerPending(timerID) {
+			return ctx.Pass()
+		}
+		return scheduleTimer(ctx, name, cron, from, data)
+	}
+}
+
+// scheduleTimer starts the timer of a Schedule for its next time after from. The time is recorded in the Control of the timer.
+// The timeout counts from the newest event of the decision task, so the timer is due at the same time when the events are decided again.
+func scheduleTimer(ctx *FSMContext, name string, cron CronSchedule, from time.Time, data interface{}) Outcome {
+	next := cron.Next(from)
+	if next.IsZero() {
+		logf(ctx, "at=schedule-never name=%s", name)
+		return ctx.Pass()
+	}
+	now := ctx.Now()
+	for _, h := range ctx.history {
+		if h.EventTimestamp != nil {
+			now = h.EventTimestamp.Time
+			break
+		}
+	}
+	seconds := int64(math.Ceil(next.Sub(now).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	logf(ctx, "at=schedule name=%s next=%s", name, next.Format(time.RFC3339))
+	ctx.timerStarted(ScheduleTimerID(name))
+	d := swf.Decision{
+		DecisionType: aws.String(swf.DecisionTypeStartTimer),
+		StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+			StartToFireTimeout: aws.String(strconv.FormatInt(seconds, 10)),
+			TimerID:            aws.String(ScheduleTimerID(name)),
+			Control:            aws.String(strconv.FormatInt(next.Unix(), 10)),
+		},
+	}
+	return Outcome{State: "", Data: data, Decisions: append(ctx.EmptyDecisions(), d)}
+}
+
+// ScheduleTimerID returns the ID of the timer Schedule starts for the schedule with name.
+func ScheduleTimerID(name string) string {
+	return ScheduleTimer + "." + name
+}
+
+// OnScheduleFired builds a composed decider that fires when the timer of the Schedule with name fires.
+func OnScheduleFired(name string, deciders ...Decider) Decider {
+	return OnTimerFired(ScheduleTimerID(name), deciders...)
+}
+
+// continuationOutstanding is the number of activities, outbound signals and child workflows a workflow is waiting on,
+// not counting the signal that asks the workflow to continue.
+func continuationOutstanding(ctx *FSMContext) int {
+	outstanding := len(ctx.eventCorrelator.Activities) + len(ctx.eventCorrelator.Children)
+	for _, signal := range ctx.eventCorrelator.Signals {
+		if signal.SignalName != ContinueSignal || signal.WorkflowID != LS(ctx.WorkflowID) {
+			outstanding++
+		}
+	}
+	return outstanding
+}
+
 //RepairState is a decider that can be composed in which updates the current state data with the one recieved in the signal.
 func RepairState() Decider {
 	return OnSignalReceived(RepiarStateSignal, UpdateState(
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/swf"
@@ -196,6 +198,72 @@ func TestOnData(t *testing.T) {}
 
 func TestOnSignalReceived(t *testing.T) {}
 
+func TestOnSignal(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddSignal("hello", &TestingType{})
+	ctx := NewFSMContext(fsm,
+		swf.WorkflowType{Name: s.S("foo"), Version: s.S("1")},
+		swf.WorkflowExecution{WorkflowID: s.S("id"), RunID: s.S("runid")},
+		&EventCorrelator{}, "state", nil, 1)
+	var received []*TestingType
+	decider := OnSignal("hello", func(ctx *FSMContext, h swf.HistoryEvent, data *TestData, payload *TestingType) Outcome {
+		received = append(received, payload)
+		return ctx.Goto("next", data, nil)
+	})
+	signaled := func(name string, input *string) swf.HistoryEvent {
+		return s.EventFromPayload(1, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S(name), Input: input})
+	}
+
+	if outcome := decider(ctx, signaled("other", s.S(`{"Field":"other"}`)), &TestData{}); outcome.State != "" {
+		t.Fatal("expected other signals to pass", outcome)
+	}
+	if outcome := decider(ctx, signaled("hello", s.S(`{"Field":"hi"}`)), &TestData{}); outcome.State != "next" {
+		t.Fatal("expected the signal to fire the decider", outcome)
+	}
+	if outcome := decider(ctx, signaled("hello", nil), &TestData{}); outcome.State != "next" {
+		t.Fatal("expected a signal without input to fire the decider", outcome)
+	}
+	if len(received) != 2 || received[0].Field != "hi" || received[1] != nil {
+		t.Fatal("expected the typed payloads", received)
+	}
+
+	mismatched := OnSignal("hello", func(ctx *FSMContext, h swf.HistoryEvent, data *TestData, payload *TestData) Outcome {
+		return ctx.Pass()
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a payload type that does not match the registered one to panic")
+			}
+		}()
+		mismatched(ctx, signaled("hello", s.S(`{}`)), &TestData{})
+	}()
+}
+
+func TestOnSignalChecksTypes(t *testing.T) {
+	bad := []interface{}{
+		"not a func",
+		func(ctx *FSMContext, h swf.HistoryEvent, data *TestData) Outcome { return Outcome{} },
+		func(ctx *FSMContext, h swf.HistoryEvent, data *TestData, payload TestingType) Outcome {
+			return Outcome{}
+		},
+		func(ctx *FSMContext, h *swf.HistoryEvent, data *TestData, payload *TestingType) Outcome {
+			return Outcome{}
+		},
+		func(ctx *FSMContext, h swf.HistoryEvent, data *TestData, payload *TestingType) {},
+	}
+	for i, decider := range bad {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected a badly typed decider to panic", i)
+				}
+			}()
+			OnSignal("hello", decider)
+		}()
+	}
+}
+
 func TestOnSignalSent(t *testing.T) {}
 
 func TestOnTimerFired(t *testing.T) {}
@@ -204,6 +272,28 @@ func TestOnSignalFailed(t *testing.T) {}
 
 func TestOnActivityCompleted(t *testing.T) {}
 
+func TestOnActivityResult(t *testing.T) {
+	ctx := testContextWithActivity(1, &swf.ActivityTaskScheduledEventAttributes{
+		ActivityID:   s.S("activity-id"),
+		ActivityType: &swf.ActivityType{Name: s.S("activity"), Version: s.S("1")},
+	})()
+	ctx.serialization = testFSM()
+	var result *TestingType
+	decider := OnActivityResult("activity", func(ctx *FSMContext, h swf.HistoryEvent, data *TestData, r *TestingType) Outcome {
+		result = r
+		return ctx.Goto("next", data, nil)
+	})
+
+	failed := s.EventFromPayload(2, &swf.ActivityTaskFailedEventAttributes{ScheduledEventID: s.L(1)})
+	if outcome := decider(ctx, failed, &TestData{}); outcome.State != "" {
+		t.Fatal("expected failures to pass", outcome)
+	}
+	completed := s.EventFromPayload(2, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventID: s.L(1), Result: s.S(`{"Field":"done"}`)})
+	if outcome := decider(ctx, completed, &TestData{}); outcome.State != "next" || result == nil || result.Field != "done" {
+		t.Fatal("expected the typed result", outcome, result)
+	}
+}
+
 func TestOnActivityFailed(t *testing.T) {}
 
 func TestAddDecision(t *testing.T) {}
@@ -234,3 +324,259 @@ func deciderTestContext() *FSMContext {
 		swf.WorkflowExecution{WorkflowID: s.S("id"), RunID: s.S("runid")},
 		nil, "state", nil, 1)
 }
+
+func TestManagedContinuations(t *testing.T) {
+	ctx := NewFSMContext(testFSM(),
+		swf.WorkflowType{Name: s.S("foo"), Version: s.S("1")},
+		swf.WorkflowExecution{WorkflowID: s.S("id"), RunID: s.S("runid")},
+		&EventCorrelator{}, "state", nil, 1)
+	decider := ManagedContinuationsWithPolicy(ContinuationPolicy{
+		MaxEvents:    10,
+		RetrySeconds: 30,
+		Compact: func(ctx *FSMContext, data interface{}) {
+			data.(*TestData).States = nil
+		},
+	})
+	data := &TestData{States: []string{"a", "b"}}
+	signaled := func(id int, name string) swf.HistoryEvent {
+		return s.EventFromPayload(id, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S(name)})
+	}
+	decisionType := func(outcome Outcome) string {
+		if len(outcome.Decisions) != 1 {
+			return ""
+		}
+		return *outcome.Decisions[0].DecisionType
+	}
+
+	if outcome := decider(ctx, signaled(5, "other"), data); outcome.State != "" {
+		t.Fatal("expected no continuation before the history is large", outcome)
+	}
+	if outcome := decider(ctx, signaled(11, "other"), data); decisionType(outcome) != swf.DecisionTypeSignalExternalWorkflowExecution {
+		t.Fatal("expected the continue signal", outcome)
+	}
+	if outcome := decider(ctx, signaled(12, "other"), data); outcome.State != "" {
+		t.Fatal("expected the continue signal to be sent once", outcome)
+	}
+
+	//outstanding work holds up the continuation
+	ctx.eventCorrelator.Track(s.EventFromPayload(13, &swf.StartChildWorkflowExecutionInitiatedEventAttributes{
+		WorkflowID:   s.S("child"),
+		WorkflowType: &swf.WorkflowType{Name: s.S("child"), Version: s.S("1")},
+	}))
+	outcome := decider(ctx, signaled(14, ContinueSignal), data)
+	if decisionType(outcome) != swf.DecisionTypeStartTimer || *outcome.Decisions[0].StartTimerDecisionAttributes.StartToFireTimeout != "30" {
+		t.Fatal("expected to wait for the child", outcome)
+	}
+
+	ctx.eventCorrelator.Track(s.EventFromPayload(15, &swf.ChildWorkflowExecutionCompletedEventAttributes{InitiatedEventID: s.L(13)}))
+	outcome = decider(ctx, s.EventFromPayload(16, &swf.TimerFiredEventAttributes{TimerID: s.S(ContinueTimer), StartedEventID: s.L(1)}), data)
+	if decisionType(outcome) != swf.DecisionTypeContinueAsNewWorkflowExecution || len(data.States) != 0 {
+		t.Fatal("expected the compacted workflow to continue", outcome, data)
+	}
+
+	//the age and size of the history are triggers too
+	ctx = NewFSMContext(testFSM(),
+		swf.WorkflowType{Name: s.S("foo"), Version: s.S("1")},
+		swf.WorkflowExecution{WorkflowID: s.S("id"), RunID: s.S("runid")},
+		&EventCorrelator{}, "state", nil, 1)
+	started := s.EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{})
+	started.EventTimestamp = &aws.UnixTimestamp{time.Unix(0, 0)}
+	ctx.started = &started
+	ctx.history = []swf.HistoryEvent{started}
+	event := signaled(2, "other")
+	event.EventTimestamp = &aws.UnixTimestamp{time.Unix(3600, 0)}
+	ctx.event = &event
+	if outcome := ManagedContinuationsWithPolicy(ContinuationPolicy{MaxAge: time.Hour})(ctx, event, data); outcome.State != "" {
+		t.Fatal("expected no continuation for a run that is not too old", outcome)
+	}
+	if outcome := ManagedContinuationsWithPolicy(ContinuationPolicy{MaxAge: time.Minute})(ctx, event, data); decisionType(outcome) != swf.DecisionTypeSignalExternalWorkflowExecution {
+		t.Fatal("expected the continue signal for an old run", outcome)
+	}
+	ctx.eventCorrelator.Continuing = false
+	if outcome := ManagedContinuationsWithPolicy(ContinuationPolicy{MaxHistoryBytes: 10})(ctx, event, data); decisionType(outcome) != swf.DecisionTypeSignalExternalWorkflowExecution {
+		t.Fatal("expected the continue signal for a large history", outcome, ctx.HistoryBytes())
+	}
+}
+
+func TestAwaitSignal(t *testing.T) {
+	ctx := deciderTestContext()
+	ctx.eventCorrelator = &EventCorrelator{}
+	decider := AwaitSignal("approval", 2*time.Hour,
+		func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Goto("approved", data, nil)
+		},
+		func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Goto("escalated", data, nil)
+		})
+	decide := func(h swf.HistoryEvent) Outcome {
+		outcome := decider(ctx, h, &TestData{})
+		ctx.eventCorrelator.Track(h)
+		return outcome
+	}
+	decisionType := func(outcome Outcome) string {
+		if len(outcome.Decisions) != 1 {
+			return ""
+		}
+		return *outcome.Decisions[0].DecisionType
+	}
+
+	outcome := decide(s.EventFromPayload(1, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("other")}))
+	if decisionType(outcome) != swf.DecisionTypeStartTimer || outcome.State != "" {
+		t.Fatal("expected the await timer to start", outcome)
+	}
+	timer := outcome.Decisions[0].StartTimerDecisionAttributes
+	if *timer.TimerID != AwaitTimerID("approval") || *timer.StartToFireTimeout != "7200" {
+		t.Fatal("expected the await timer", s.PrettyDecision(outcome.Decisions[0]))
+	}
+	if outcome := decide(s.EventFromPayload(2, &swf.TimerStartedEventAttributes{TimerID: timer.TimerID, StartToFireTimeout: timer.StartToFireTimeout})); len(outcome.Decisions) != 0 {
+		t.Fatal("expected the started timer not to be started again", outcome)
+	}
+	if outcome := decide(s.EventFromPayload(3, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("other")})); len(outcome.Decisions) != 0 {
+		t.Fatal("expected the open timer not to be started again", outcome)
+	}
+
+	//a concurrent await for another signal has its own timer
+	other := AwaitSignal("review", time.Hour, DefaultDecider(), DefaultDecider())
+	if outcome := other(ctx, s.EventFromPayload(4, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("other")}), &TestData{}); decisionType(outcome) != swf.DecisionTypeStartTimer ||
+		*outcome.Decisions[0].StartTimerDecisionAttributes.TimerID != AwaitTimerID("review") {
+		t.Fatal("expected the other await to start its own timer", outcome)
+	}
+
+	outcome = decide(s.EventFromPayload(5, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("approval")}))
+	if outcome.State != "approved" || decisionType(outcome) != swf.DecisionTypeCancelTimer ||
+		*outcome.Decisions[0].CancelTimerDecisionAttributes.TimerID != AwaitTimerID("approval") {
+		t.Fatal("expected the signal to cancel the timer and win", outcome)
+	}
+
+	//the timer wins
+	ctx.eventCorrelator = &EventCorrelator{}
+	decide(s.EventFromPayload(6, &swf.TimerStartedEventAttributes{TimerID: timer.TimerID, StartToFireTimeout: timer.StartToFireTimeout}))
+	outcome = decide(s.EventFromPayload(7, &swf.TimerFiredEventAttributes{TimerID: timer.TimerID, StartedEventID: s.L(6)}))
+	if outcome.State != "escalated" || len(outcome.Decisions) != 0 {
+		t.Fatal("expected the timeout to escalate", outcome)
+	}
+	if ctx.eventCorrelator.TimerOpen(AwaitTimerID("approval")) {
+		t.Fatal("expected the fired timer to be closed")
+	}
+
+	//the signal arrives in the decision task that starts the timer
+	ctx = deciderTestContext()
+	ctx.eventCorrelator = &EventCorrelator{}
+	decide(s.EventFromPayload(8, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("other")}))
+	outcome = decide(s.EventFromPayload(9, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("approval")}))
+	if outcome.State != "approved" || decisionType(outcome) != swf.DecisionTypeCancelTimer {
+		t.Fatal("expected the timer started in the same decision task to be canceled", outcome)
+	}
+
+	//awaits for the same signal with different ids have their own timers
+	first := AwaitSignalWithID("approval", "first", time.Hour, DefaultDecider(), DefaultDecider())
+	second := AwaitSignalWithID("approval", "second", time.Hour, DefaultDecider(), DefaultDecider())
+	h := s.EventFromPayload(10, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("other")})
+	a, b := first(ctx, h, &TestData{}), second(ctx, h, &TestData{})
+	if decisionType(a) != swf.DecisionTypeStartTimer || decisionType(b) != swf.DecisionTypeStartTimer ||
+		*a.Decisions[0].StartTimerDecisionAttributes.TimerID != AwaitTimerIDWithID("approval", "first") ||
+		*b.Decisions[0].StartTimerDecisionAttributes.TimerID != AwaitTimerIDWithID("approval", "second") {
+		t.Fatal("expected each await to start its own timer", a, b)
+	}
+	if outcome := CancelAwaitWithID("approval", "second")(ctx, h, &TestData{}); decisionType(outcome) != swf.DecisionTypeCancelTimer ||
+		*outcome.Decisions[0].CancelTimerDecisionAttributes.TimerID != AwaitTimerIDWithID("approval", "second") {
+		t.Fatal("expected the await with the id to be canceled", outcome)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ctx := deciderTestContext()
+	ctx.eventCorrelator = &EventCorrelator{}
+	fired := 0
+	decider := NewComposedDecider(
+		Schedule("report", "@hourly"),
+		OnScheduleFired("report", func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			fired++
+			return ctx.Stay(data, nil)
+		}),
+	)
+	event := func(id int, at time.Time, attributes interface{}) swf.HistoryEvent {
+		h := s.EventFromPayload(id, attributes)
+		h.EventTimestamp = &aws.UnixTimestamp{at}
+		ctx.event = &h
+		ctx.history = []swf.HistoryEvent{h}
+		return h
+	}
+	decide := func(h swf.HistoryEvent) Outcome {
+		outcome := decider(ctx, h, &TestData{})
+		ctx.eventCorrelator.Track(h)
+		return outcome
+	}
+	timer := func(outcome Outcome) *swf.StartTimerDecisionAttributes {
+		if len(outcome.Decisions) != 1 || *outcome.Decisions[0].DecisionType != swf.DecisionTypeStartTimer {
+			t.Fatal("expected a timer", outcome)
+		}
+		return outcome.Decisions[0].StartTimerDecisionAttributes
+	}
+	start := time.Date(2015, 6, 10, 10, 15, 30, 0, time.UTC)
+
+	started := timer(decide(event(1, start, &swf.WorkflowExecutionStartedEventAttributes{})))
+	if *started.TimerID != ScheduleTimerID("report") || *started.StartToFireTimeout != "2670" ||
+		*started.Control != strconv.FormatInt(time.Date(2015, 6, 10, 11, 0, 0, 0, time.UTC).Unix(), 10) {
+		t.Fatal("expected the timer for the next hour", s.PrettyDecision(swf.Decision{StartTimerDecisionAttributes: started}))
+	}
+	decide(event(2, start, &swf.TimerStartedEventAttributes{TimerID: started.TimerID, Control: started.Control, StartToFireTimeout: started.StartToFireTimeout}))
+	if outcome := decide(event(3, start.Add(time.Minute), &swf.WorkflowExecutionSignaledEventAttributes{SignalName: s.S("other")})); len(outcome.Decisions) != 0 {
+		t.Fatal("expected the open timer not to be started again", outcome)
+	}
+
+	//a timer that fires a little early is started again for the time after the one it was due at
+	outcome := decide(event(4, time.Date(2015, 6, 10, 10, 59, 59, 0, time.UTC), &swf.TimerFiredEventAttributes{TimerID: started.TimerID, StartedEventID: s.L(2)}))
+	rearmed := timer(outcome)
+	if fired != 1 || outcome.State != "state" || *rearmed.StartToFireTimeout != "3601" ||
+		*rearmed.Control != strconv.FormatInt(time.Date(2015, 6, 10, 12, 0, 0, 0, time.UTC).Unix(), 10) {
+		t.Fatal("expected the schedule to fire and start the timer for the next hour", fired, outcome)
+	}
+}
+
+func TestScheduleAndAwaitInContinuedRun(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: NewComposedDecider(
+			Schedule("report", "@hourly"),
+			AwaitSignal("approval", 2*time.Hour, DefaultDecider(), DefaultDecider()),
+			DefaultDecider(),
+		),
+	})
+	fsm.Init()
+
+	ctx := testContext(fsm)
+	ctx.event = &swf.HistoryEvent{EventTimestamp: &aws.UnixTimestamp{time.Unix(1000, 0)}}
+	for i, id := range []string{ScheduleTimerID("report"), AwaitTimerID("approval")} {
+		ctx.eventCorrelator.Track(swf.HistoryEvent{
+			EventID:                     s.I(i + 1),
+			EventType:                   s.S(swf.EventTypeTimerStarted),
+			EventTimestamp:              &aws.UnixTimestamp{time.Unix(900, 0)},
+			TimerStartedEventAttributes: &swf.TimerStartedEventAttributes{TimerID: s.S(id), StartToFireTimeout: s.S("600")},
+		})
+	}
+	cont := ctx.ContinueWorkflowDecision("waiting", &TestData{})
+
+	continued := swf.HistoryEvent{
+		EventType: s.S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:                   cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+			ContinuedExecutionRunID: s.S("previous"),
+		},
+	}
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{continued}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(map[string][]string)
+	for _, d := range decisions {
+		if *d.DecisionType == swf.DecisionTypeStartTimer {
+			id := *d.StartTimerDecisionAttributes.TimerID
+			started[id] = append(started[id], *d.StartTimerDecisionAttributes.StartToFireTimeout)
+		}
+	}
+	if !reflect.DeepEqual(started, map[string][]string{ScheduleTimerID("report"): []string{"500"}, AwaitTimerID("approval"): []string{"500"}}) {
+		t.Fatal("expected the timers to be started again once, with the time they had left", started)
+	}
+}
@@ -0,0 +1,136 @@
+package fsm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// encryptedPrefix marks an encrypted payload, which is followed by the key id, a colon, and the base64 encoded nonce and ciphertext.
+const encryptedPrefix = "enc:"
+
+// KeyProvider supplies the AES keys used by an EncryptingStateSerializer.
+// Keys must be 16, 24 or 32 bytes long, and key ids must not contain a colon.
+type KeyProvider interface {
+	// CurrentKey returns the id of the key used to encrypt new payloads, and the key itself.
+	CurrentKey() (string, []byte, error)
+	// Key returns the key with the given id, so payloads encrypted before a key rotation can still be decrypted.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider backed by a map of key ids to keys.
+// To rotate keys, add the new key and make it the CurrentKeyID, and keep the old keys until no workflow needs them.
+type StaticKeyProvider struct {
+	CurrentKeyID string
+	Keys         map[string][]byte
+}
+
+// CurrentKey returns the key with CurrentKeyID.
+func (s StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := s.Key(s.CurrentKeyID)
+	return s.CurrentKeyID, key, err
+}
+
+// Key returns the key with the given id.
+func (s StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, errors.Errorf("no key with id %q", id)
+	}
+	return key, nil
+}
+
+// EncryptingStateSerializer is a StateSerializer that wraps another StateSerializer and encrypts its output with AES-GCM.
+// Each payload is tagged with the id of the key that encrypted it, so keys can be rotated without breaking open workflows.
+//
+// Payloads that are not encrypted, such as the inputs of workflows started before encryption was turned on,
+// are passed to the wrapped StateSerializer as they are, unless RejectPlaintext is set.
+//
+// When combined with a CompressingStateSerializer, compress first, since encrypted payloads do not compress:
+// EncryptingStateSerializer{Serializer: CompressingStateSerializer{...}, ...}
+type EncryptingStateSerializer struct {
+	Serializer      StateSerializer
+	Keys            KeyProvider
+	RejectPlaintext bool
+}
+
+// Serialize serializes with the wrapped StateSerializer and encrypts the result with the current key.
+func (e EncryptingStateSerializer) Serialize(state interface{}) (string, error) {
+	serialized, err := e.Serializer.Serialize(state)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	id, key, err := e.Keys.CurrentKey()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if strings.Contains(id, ":") {
+		return "", errors.Errorf("key id %q must not contain a colon", id)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Trace(err)
+	}
+	//the key id is authenticated along with the ciphertext, so it can not be swapped
+	sealed := gcm.Seal(nonce, nonce, []byte(serialized), []byte(id))
+	return encryptedPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Deserialize decrypts the serialized string with the key it was tagged with, and deserializes it with the wrapped StateSerializer.
+func (e EncryptingStateSerializer) Deserialize(serialized string, state interface{}) error {
+	if !strings.HasPrefix(serialized, encryptedPrefix) {
+		if e.RejectPlaintext {
+			return errors.New("refusing to deserialize an unencrypted payload")
+		}
+		return e.Serializer.Deserialize(serialized, state)
+	}
+
+	tagged := serialized[len(encryptedPrefix):]
+	sep := strings.Index(tagged, ":")
+	if sep < 0 {
+		return errors.New("encrypted payload is missing its key id")
+	}
+	id := tagged[:sep]
+	sealed, err := base64.StdEncoding.DecodeString(tagged[sep+1:])
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	key, err := e.Keys.Key(id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return errors.New("encrypted payload is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return errors.Annotatef(err, "decrypting payload with key %q", id)
+	}
+	return e.Serializer.Deserialize(string(plaintext), state)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return cipher.NewGCM(block)
+}
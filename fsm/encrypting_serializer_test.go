@@ -0,0 +1,112 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func testKeys() StaticKeyProvider {
+	return StaticKeyProvider{
+		CurrentKeyID: "k1",
+		Keys: map[string][]byte{
+			"k1": []byte("0123456789abcdef0123456789abcdef"),
+			"k2": []byte("fedcba9876543210fedcba9876543210"),
+		},
+	}
+}
+
+func TestEncryptingStateSerializer(t *testing.T) {
+	keys := testKeys()
+	ser := EncryptingStateSerializer{Serializer: JSONStateSerializer{}, Keys: keys}
+
+	serialized, err := ser.Serialize(&TestData{States: []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(serialized, "enc:k1:") || strings.Contains(serialized, "secret") {
+		t.Fatal("expected an encrypted payload tagged with the key id", serialized)
+	}
+
+	//rotate keys, old payloads still decrypt
+	keys.CurrentKeyID = "k2"
+	rotated := EncryptingStateSerializer{Serializer: JSONStateSerializer{}, Keys: keys}
+	read := &TestData{}
+	if err := rotated.Deserialize(serialized, read); err != nil {
+		t.Fatal(err)
+	}
+	if read.States[0] != "secret" {
+		t.Fatal(read)
+	}
+	reserialized, _ := rotated.Serialize(read)
+	if !strings.HasPrefix(reserialized, "enc:k2:") {
+		t.Fatal("expected the new key to be used", reserialized)
+	}
+
+	//the key id is authenticated
+	tampered := strings.Replace(serialized, "enc:k1:", "enc:k2:", 1)
+	if err := rotated.Deserialize(tampered, read); err == nil {
+		t.Fatal("expected tampered payload to fail")
+	}
+
+	plaintext := `{"States":["plain"]}`
+	if err := ser.Deserialize(plaintext, read); err != nil || read.States[0] != "plain" {
+		t.Fatal("expected plaintext to be read", err, read)
+	}
+	ser.RejectPlaintext = true
+	if err := ser.Deserialize(plaintext, read); err == nil {
+		t.Fatal("expected plaintext to be rejected")
+	}
+}
+
+func TestEncryptingStateSerializerInFSM(t *testing.T) {
+	client := &MockClient{}
+	rep := KinesisReplication{
+		KinesisStream:     "test-stream",
+		KinesisOps:        client,
+		KinesisReplicator: defaultKinesisReplicator(),
+	}
+	fsm := testFSM()
+	fsm.Serializer = EncryptingStateSerializer{Serializer: JSONStateSerializer{}, Keys: testKeys()}
+	fsm.SWF = client
+	fsm.ReplicationHandler = rep.Handler
+	fsm.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			started := &TestData{}
+			f.EventData(h, started)
+			return f.Goto("done", started, nil)
+		},
+	})
+	fsm.AddState(&FSMState{Name: "done", Decider: Stay()})
+
+	events := []swf.HistoryEvent{
+		swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventID: I(3)},
+		swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventID: I(2)},
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S("WorkflowExecutionStarted"),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(&TestData{States: []string{"secret"}})),
+			},
+		},
+	}
+	fsm.handleDecisionTask(testDecisionTask(0, events))
+
+	if len(client.putRecords) != 1 {
+		t.Fatal("expected a replicated state", client.putRecords)
+	}
+	record := string(client.putRecords[0].Data)
+	if strings.Contains(record, "secret") {
+		t.Fatal("replicated state is not encrypted", record)
+	}
+	var replicated ReplicationData
+	fsm.Deserialize(record, &replicated)
+	data := &TestData{}
+	fsm.Deserialize(replicated.StateData, data)
+	if replicated.StateName != "done" || data.States[0] != "secret" {
+		t.Fatal("unexpected replicated state", replicated, data)
+	}
+}
@@ -0,0 +1,126 @@
+package fsm
+
+import (
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	"github.com/juju/errors"
+	s "github.com/sclasen/swfsm/sugar"
+)
+
+// eventPayloads finds the serialized payload of each type of HistoryEvent that carries one.
+var eventPayloads = map[string]func(swf.HistoryEvent) *string{
+	swf.EventTypeWorkflowExecutionStarted:             func(h swf.HistoryEvent) *string { return h.WorkflowExecutionStartedEventAttributes.Input },
+	swf.EventTypeWorkflowExecutionCompleted:           func(h swf.HistoryEvent) *string { return h.WorkflowExecutionCompletedEventAttributes.Result },
+	swf.EventTypeWorkflowExecutionFailed:              func(h swf.HistoryEvent) *string { return h.WorkflowExecutionFailedEventAttributes.Details },
+	swf.EventTypeWorkflowExecutionCanceled:            func(h swf.HistoryEvent) *string { return h.WorkflowExecutionCanceledEventAttributes.Details },
+	swf.EventTypeWorkflowExecutionContinuedAsNew:      func(h swf.HistoryEvent) *string { return h.WorkflowExecutionContinuedAsNewEventAttributes.Input },
+	swf.EventTypeWorkflowExecutionTerminated:          func(h swf.HistoryEvent) *string { return h.WorkflowExecutionTerminatedEventAttributes.Details },
+	swf.EventTypeWorkflowExecutionSignaled:            func(h swf.HistoryEvent) *string { return h.WorkflowExecutionSignaledEventAttributes.Input },
+	swf.EventTypeActivityTaskScheduled:                func(h swf.HistoryEvent) *string { return h.ActivityTaskScheduledEventAttributes.Input },
+	swf.EventTypeActivityTaskCompleted:                func(h swf.HistoryEvent) *string { return h.ActivityTaskCompletedEventAttributes.Result },
+	swf.EventTypeActivityTaskFailed:                   func(h swf.HistoryEvent) *string { return h.ActivityTaskFailedEventAttributes.Details },
+	swf.EventTypeActivityTaskTimedOut:                 func(h swf.HistoryEvent) *string { return h.ActivityTaskTimedOutEventAttributes.Details },
+	swf.EventTypeActivityTaskCanceled:                 func(h swf.HistoryEvent) *string { return h.ActivityTaskCanceledEventAttributes.Details },
+	swf.EventTypeMarkerRecorded:                       func(h swf.HistoryEvent) *string { return h.MarkerRecordedEventAttributes.Details },
+	swf.EventTypeTimerStarted:                         func(h swf.HistoryEvent) *string { return h.TimerStartedEventAttributes.Control },
+	swf.EventTypeStartChildWorkflowExecutionInitiated: func(h swf.HistoryEvent) *string { return h.StartChildWorkflowExecutionInitiatedEventAttributes.Input },
+	swf.EventTypeStartChildWorkflowExecutionFailed:    func(h swf.HistoryEvent) *string { return h.StartChildWorkflowExecutionFailedEventAttributes.Control },
+	swf.EventTypeChildWorkflowExecutionCompleted:      func(h swf.HistoryEvent) *string { return h.ChildWorkflowExecutionCompletedEventAttributes.Result },
+	swf.EventTypeChildWorkflowExecutionFailed:         func(h swf.HistoryEvent) *string { return h.ChildWorkflowExecutionFailedEventAttributes.Details },
+	swf.EventTypeChildWorkflowExecutionCanceled:       func(h swf.HistoryEvent) *string { return h.ChildWorkflowExecutionCanceledEventAttributes.Details },
+	swf.EventTypeSignalExternalWorkflowExecutionInitiated: func(h swf.HistoryEvent) *string {
+		return h.SignalExternalWorkflowExecutionInitiatedEventAttributes.Input
+	},
+	swf.EventTypeSignalExternalWorkflowExecutionFailed: func(h swf.HistoryEvent) *string {
+		return h.SignalExternalWorkflowExecutionFailedEventAttributes.Control
+	},
+	swf.EventTypeRequestCancelExternalWorkflowExecutionInitiated: func(h swf.HistoryEvent) *string {
+		return h.RequestCancelExternalWorkflowExecutionInitiatedEventAttributes.Control
+	},
+	swf.EventTypeRequestCancelExternalWorkflowExecutionFailed: func(h swf.HistoryEvent) *string {
+		return h.RequestCancelExternalWorkflowExecutionFailedEventAttributes.Control
+	},
+}
+
+// eventReasons finds why the event happened, for the types of HistoryEvent that record a reason, cause or timeout type.
+var eventReasons = map[string]func(swf.HistoryEvent) *string{
+	swf.EventTypeWorkflowExecutionCancelRequested:      func(h swf.HistoryEvent) *string { return h.WorkflowExecutionCancelRequestedEventAttributes.Cause },
+	swf.EventTypeWorkflowExecutionFailed:               func(h swf.HistoryEvent) *string { return h.WorkflowExecutionFailedEventAttributes.Reason },
+	swf.EventTypeWorkflowExecutionTimedOut:             func(h swf.HistoryEvent) *string { return h.WorkflowExecutionTimedOutEventAttributes.TimeoutType },
+	swf.EventTypeWorkflowExecutionTerminated:           func(h swf.HistoryEvent) *string { return h.WorkflowExecutionTerminatedEventAttributes.Reason },
+	swf.EventTypeCompleteWorkflowExecutionFailed:       func(h swf.HistoryEvent) *string { return h.CompleteWorkflowExecutionFailedEventAttributes.Cause },
+	swf.EventTypeFailWorkflowExecutionFailed:           func(h swf.HistoryEvent) *string { return h.FailWorkflowExecutionFailedEventAttributes.Cause },
+	swf.EventTypeCancelWorkflowExecutionFailed:         func(h swf.HistoryEvent) *string { return h.CancelWorkflowExecutionFailedEventAttributes.Cause },
+	swf.EventTypeContinueAsNewWorkflowExecutionFailed:  func(h swf.HistoryEvent) *string { return h.ContinueAsNewWorkflowExecutionFailedEventAttributes.Cause },
+	swf.EventTypeDecisionTaskTimedOut:                  func(h swf.HistoryEvent) *string { return h.DecisionTaskTimedOutEventAttributes.TimeoutType },
+	swf.EventTypeScheduleActivityTaskFailed:            func(h swf.HistoryEvent) *string { return h.ScheduleActivityTaskFailedEventAttributes.Cause },
+	swf.EventTypeActivityTaskFailed:                    func(h swf.HistoryEvent) *string { return h.ActivityTaskFailedEventAttributes.Reason },
+	swf.EventTypeActivityTaskTimedOut:                  func(h swf.HistoryEvent) *string { return h.ActivityTaskTimedOutEventAttributes.TimeoutType },
+	swf.EventTypeRequestCancelActivityTaskFailed:       func(h swf.HistoryEvent) *string { return h.RequestCancelActivityTaskFailedEventAttributes.Cause },
+	swf.EventTypeRecordMarkerFailed:                    func(h swf.HistoryEvent) *string { return h.RecordMarkerFailedEventAttributes.Cause },
+	swf.EventTypeStartTimerFailed:                      func(h swf.HistoryEvent) *string { return h.StartTimerFailedEventAttributes.Cause },
+	swf.EventTypeCancelTimerFailed:                     func(h swf.HistoryEvent) *string { return h.CancelTimerFailedEventAttributes.Cause },
+	swf.EventTypeStartChildWorkflowExecutionFailed:     func(h swf.HistoryEvent) *string { return h.StartChildWorkflowExecutionFailedEventAttributes.Cause },
+	swf.EventTypeChildWorkflowExecutionFailed:          func(h swf.HistoryEvent) *string { return h.ChildWorkflowExecutionFailedEventAttributes.Reason },
+	swf.EventTypeChildWorkflowExecutionTimedOut:        func(h swf.HistoryEvent) *string { return h.ChildWorkflowExecutionTimedOutEventAttributes.TimeoutType },
+	swf.EventTypeSignalExternalWorkflowExecutionFailed: func(h swf.HistoryEvent) *string { return h.SignalExternalWorkflowExecutionFailedEventAttributes.Cause },
+	swf.EventTypeRequestCancelExternalWorkflowExecutionFailed: func(h swf.HistoryEvent) *string {
+		return h.RequestCancelExternalWorkflowExecutionFailedEventAttributes.Cause
+	},
+}
+
+// EventPayload returns the serialized payload of the event: the input, result, details or control,
+// depending on its type. It returns false when the type of event carries no payload, or its attributes or payload are missing.
+func EventPayload(h swf.HistoryEvent) (string, bool) {
+	return eventString(eventPayloads, h)
+}
+
+// EventReason returns the reason, cause or timeout type recorded on a failed, timed out, terminated or cancel requested event.
+// It returns false when the type of event records none, or its attributes or reason are missing.
+func EventReason(h swf.HistoryEvent) (string, bool) {
+	return eventString(eventReasons, h)
+}
+
+func eventString(fields map[string]func(swf.HistoryEvent) *string, h swf.HistoryEvent) (value string, ok bool) {
+	if h.EventType == nil {
+		return "", false
+	}
+	field, ok := fields[*h.EventType]
+	if !ok {
+		return "", false
+	}
+	defer func() {
+		//the attributes struct for the event type is missing
+		if r := recover(); r != nil {
+			value, ok = "", false
+		}
+	}()
+	if p := field(h); p != nil && *p != "" {
+		return *p, true
+	}
+	return "", false
+}
+
+// TryEventData is EventData that returns an error, rather than panicking, when the event has no payload or it can not be deserialized.
+func (f *FSM) TryEventData(event swf.HistoryEvent, eventData interface{}) error {
+	if eventData == nil {
+		return nil
+	}
+	serialized, ok := EventPayload(event)
+	if !ok {
+		return errors.Errorf("event payload was empty for %s", s.PrettyHistoryEvent(event))
+	}
+	if err := f.Serializer.Deserialize(serialized, eventData); err != nil {
+		return errors.Annotatef(err, "event payload could not be deserialized for %s", s.PrettyHistoryEvent(event))
+	}
+	return nil
+}
+
+// EventData works in combination with the FSM.Serializer to provide
+// deserialization of data sent in a HistoryEvent. It is sugar around extracting the event payload from the proper
+// field of the proper Attributes struct on the HistoryEvent, see EventPayload. It panics when there is no payload
+// or it can not be deserialized, use TryEventData to handle those errors instead.
+func (f *FSM) EventData(event swf.HistoryEvent, eventData interface{}) {
+	if err := f.TryEventData(event, eventData); err != nil {
+		panic(err)
+	}
+}
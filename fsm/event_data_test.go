@@ -0,0 +1,93 @@
+package fsm
+
+import (
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func TestEventDataCoversPayloads(t *testing.T) {
+	fsm := testFSM()
+	payload := S(`{"States":["payload"]}`)
+	events := []interface{}{
+		&swf.WorkflowExecutionStartedEventAttributes{Input: payload},
+		&swf.WorkflowExecutionCompletedEventAttributes{Result: payload},
+		&swf.WorkflowExecutionFailedEventAttributes{Details: payload},
+		&swf.WorkflowExecutionCanceledEventAttributes{Details: payload},
+		&swf.WorkflowExecutionContinuedAsNewEventAttributes{Input: payload},
+		&swf.WorkflowExecutionTerminatedEventAttributes{Details: payload},
+		&swf.WorkflowExecutionSignaledEventAttributes{Input: payload},
+		&swf.ActivityTaskScheduledEventAttributes{Input: payload},
+		&swf.ActivityTaskCompletedEventAttributes{Result: payload},
+		&swf.ActivityTaskFailedEventAttributes{Details: payload},
+		&swf.ActivityTaskTimedOutEventAttributes{Details: payload},
+		&swf.ActivityTaskCanceledEventAttributes{Details: payload},
+		&swf.MarkerRecordedEventAttributes{Details: payload},
+		&swf.TimerStartedEventAttributes{Control: payload},
+		&swf.StartChildWorkflowExecutionInitiatedEventAttributes{Input: payload},
+		&swf.StartChildWorkflowExecutionFailedEventAttributes{Control: payload},
+		&swf.ChildWorkflowExecutionCompletedEventAttributes{Result: payload},
+		&swf.ChildWorkflowExecutionFailedEventAttributes{Details: payload},
+		&swf.ChildWorkflowExecutionCanceledEventAttributes{Details: payload},
+		&swf.SignalExternalWorkflowExecutionInitiatedEventAttributes{Input: payload},
+		&swf.SignalExternalWorkflowExecutionFailedEventAttributes{Control: payload},
+		&swf.RequestCancelExternalWorkflowExecutionInitiatedEventAttributes{Control: payload},
+		&swf.RequestCancelExternalWorkflowExecutionFailedEventAttributes{Control: payload},
+	}
+	if len(events) != len(eventPayloads) {
+		t.Fatal("expected a test event for each payload", len(events), len(eventPayloads))
+	}
+	for i, attributes := range events {
+		event := EventFromPayload(i+1, attributes)
+		data := &TestData{}
+		fsm.EventData(event, data)
+		if len(data.States) != 1 || data.States[0] != "payload" {
+			t.Fatal("expected the payload to be extracted", PrettyHistoryEvent(event), data)
+		}
+	}
+}
+
+func TestTryEventData(t *testing.T) {
+	fsm := testFSM()
+	ctx := testContext(fsm)
+
+	bad := []swf.HistoryEvent{
+		EventFromPayload(1, &swf.ChildWorkflowExecutionFailedEventAttributes{Reason: S("reason")}),
+		EventFromPayload(2, &swf.TimerFiredEventAttributes{TimerID: S("timer")}),
+		EventFromPayload(3, &swf.ActivityTaskCompletedEventAttributes{Result: S("not json")}),
+		swf.HistoryEvent{EventType: S(swf.EventTypeActivityTaskCompleted)},
+	}
+	for _, event := range bad {
+		if err := ctx.TryEventData(event, &TestData{}); err == nil {
+			t.Fatal("expected an error", PrettyHistoryEvent(event))
+		}
+	}
+
+	func() {
+		defer func() {
+			if _, ok := recover().(error); !ok {
+				t.Fatal("expected EventData to panic with the error on an empty payload")
+			}
+		}()
+		ctx.EventData(bad[0], &TestData{})
+	}()
+
+	if err := ctx.TryEventData(bad[0], nil); err != nil {
+		t.Fatal("expected nil data to be ignored", err)
+	}
+}
+
+func TestEventReason(t *testing.T) {
+	failed := EventFromPayload(1, &swf.ChildWorkflowExecutionFailedEventAttributes{Reason: S("child broke")})
+	if reason, ok := EventReason(failed); !ok || reason != "child broke" {
+		t.Fatal("expected the reason of the child failure", reason, ok)
+	}
+	timedOut := EventFromPayload(2, &swf.ActivityTaskTimedOutEventAttributes{TimeoutType: S("HEARTBEAT")})
+	if reason, ok := EventReason(timedOut); !ok || reason != "HEARTBEAT" {
+		t.Fatal("expected the timeout type", reason, ok)
+	}
+	if reason, ok := EventReason(EventFromPayload(3, &swf.TimerFiredEventAttributes{})); ok {
+		t.Fatal("expected no reason", reason)
+	}
+}
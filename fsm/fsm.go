@@ -4,15 +4,19 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/swf"
 	"github.com/juju/errors"
 	"github.com/sclasen/swfsm/poller"
-	s "github.com/sclasen/swfsm/sugar"
 )
 
-//SWFOps is the subset of swf.SWF ops required by the fsm package
+// SWFOps is the subset of swf.SWF ops required by the fsm package
 type SWFOps interface {
 	PollForDecisionTask(*swf.PollForDecisionTaskInput) (*swf.DecisionTask, error)
 	PollForActivityTask(*swf.PollForActivityTaskInput) (*swf.ActivityTask, error)
@@ -36,10 +40,14 @@ type FSM struct {
 	// DataType of the data struct associated with this FSM.
 	// The data is automatically peristed to and loaded from workflow history by the FSM.
 	DataType interface{}
+	// DataVersion is the schema version of the DataType, which is recorded along with the data.
+	// Data recorded with an older version is migrated by the Upcasters added with AddUpcaster before it is deserialized.
+	DataVersion int
 	// Serializer used to serialize/deserialise fsm state data to/from workflow history.
 	Serializer StateSerializer
-	// Serializer used to serialize/deserialise in json the fsm managed marker recorded events to/from workflow history.
-	systemSerializer StateSerializer
+	// SystemSerializer used to serialize/deserialise the fsm managed marker recorded events to/from workflow history.
+	// Defaults to a json MarkerSerializer. Use MarkerSerializer{Binary: true} for a more compact encoding.
+	SystemSerializer StateSerializer
 	//PollerShutdownManager is used when the FSM is managing the polling
 	ShutdownManager *poller.ShutdownManager
 	//DecisionTaskDispatcher determines the concurrency strategy for processing tasks in your fsm
@@ -60,13 +68,45 @@ type FSM struct {
 	DecisionErrorHandler DecisionErrorHandler
 	//FSMErrorReporter  is called whenever there is an error within the FSM, usually indicating bad state or configuration of your FSM.
 	FSMErrorReporter FSMErrorReporter
-	states           map[string]*FSMState
-	errorHandlers    map[string]DecisionErrorHandler
-	initialState     *FSMState
-	completeState    *FSMState
-	stop             chan bool
-	stopAck          chan bool
-	allowPanics      bool //makes testing easier
+	// StateCache, if set, holds the deserialized state data and event correlator of recently completed decision tasks,
+	// so the next decision task for the same workflow run does not need to deserialize them from history.
+	StateCache StateCache
+	// DataCopier is used to copy the state data before each decider runs. Defaults to a SerializingDataCopier using the Serializer.
+	DataCopier DataCopier
+	// StashLimit is the most events FSMContext.Stash will hold for a workflow run. When it is reached the oldest stashed event is dropped.
+	// Defaults to DefaultStashLimit.
+	StashLimit int
+	// StashExpiry, if set, drops stashed events that are older than StashExpiry by the time they would be replayed.
+	StashExpiry time.Duration
+	// OnCancelRequested, if set, turns on managed cancellation. When a WorkflowExecutionCancelRequested event arrives it is called
+	// in place of the current state's Decider, and the Decisions and Data of its Outcome are kept, but its State is ignored.
+	// The FSM then requests cancellation of all outstanding activities and timers, and moves to the cancel state,
+	// which responds with a CancelWorkflowExecution decision once they have settled. See AddCancelState.
+	OnCancelRequested Decider
+	// MaxCloseDecisionRetries is how many times the FSM retries a close decision that failed because new events arrived
+	// while it was being made. Defaults to DefaultCloseDecisionRetries, and a negative value turns the retries off.
+	// When a CompleteWorkflowExecutionFailed, FailWorkflowExecutionFailed, CancelWorkflowExecutionFailed or ContinueAsNewWorkflowExecutionFailed
+	// event arrives, the new events are decided by the state that made the close decision, and then the close decision is retried,
+	// unless one of those Deciders closed the workflow again. Once the retries are used up the failed event goes to the Decider of the current state.
+	MaxCloseDecisionRetries int
+	// OnCloseDecisionFailed, if set, is called for the failed event in place of FSMContext.RetryCloseDecision, which it can call itself.
+	OnCloseDecisionFailed Decider
+	// ErrorRecovery, if set, retries the events a Decider failed on, when the DecisionErrorHandler does not rescue them, with backoff timers,
+	// and moves the workflow to the ErrorState when the retries run out. See ErrorRecoveryPolicy.
+	ErrorRecovery *ErrorRecoveryPolicy
+	// ContinueAsNew sets the execution settings of continued runs, like the task list, tags, child policy, timeouts and workflow type version.
+	// The settings it leaves nil are those of the current run. Its Input is ignored, the FSM sets it. See FSMContext.ContinueWorkflowDecision.
+	ContinueAsNew *swf.ContinueAsNewWorkflowExecutionDecisionAttributes
+	states        map[string]*FSMState
+	errorHandlers map[string]DecisionErrorHandler
+	upcasters     map[int]Upcaster
+	signals       map[string]reflect.Type
+	initialState  *FSMState
+	completeState *FSMState
+	cancelState   *FSMState
+	stop          chan bool
+	stopAck       chan bool
+	allowPanics   bool //makes testing easier
 }
 
 // StateSerializer is the implementation of FSMSerializer.StateSerializer()
@@ -100,6 +140,13 @@ func (f *FSM) AddCompleteState(state *FSMState) {
 	f.completeState = state
 }
 
+// AddCancelState adds a state to the FSM and uses it as the state of a workflow that is being cancelled, see FSM.OnCancelRequested.
+// It receives events until the outstanding activities and timers have settled, and again if the CancelWorkflowExecution decision fails.
+func (f *FSM) AddCancelState(state *FSMState) {
+	f.AddState(state)
+	f.cancelState = state
+}
+
 // AddInitialStateWithHandler adds a state to the FSM and uses it as the initial state when a workflow execution is started.
 // it uses the FSM DefaultDecisionErrorHandler, which defaults to FSM.DefaultDecisionErrorHandler if unset.
 func (f *FSM) AddInitialStateWithHandler(state *FSMState, handler DecisionErrorHandler) {
@@ -116,6 +163,29 @@ func (f *FSM) AddErrorHandler(state string, handler DecisionErrorHandler) {
 	f.errorHandlers[state] = handler
 }
 
+// AddUpcaster adds an Upcaster that migrates serialized state data from fromVersion to fromVersion+1.
+// Upcasters are chained, so data recorded at version 1 is run through the upcasters for 1, 2, ... up to the FSM.DataVersion.
+func (f *FSM) AddUpcaster(fromVersion int, upcaster Upcaster) {
+	if f.upcasters == nil {
+		f.upcasters = make(map[int]Upcaster)
+	}
+	f.upcasters[fromVersion] = upcaster
+}
+
+// AddSignal registers the type of the payload of the signal with signalName, which is given as a pointer to an example of it.
+// FSMClient.Signal checks the input it sends against the registered type, and OnSignal deciders check their payload type against it.
+func (f *FSM) AddSignal(signalName string, payloadType interface{}) {
+	if f.signals == nil {
+		f.signals = make(map[string]reflect.Type)
+	}
+	f.signals[signalName] = indirectType(reflect.TypeOf(payloadType))
+}
+
+// SignalType returns the type registered for the payload of the signal with signalName, or nil if there is none.
+func (f *FSM) SignalType(signalName string) reflect.Type {
+	return f.signals[signalName]
+}
+
 // AddCompleteStateWithHandler adds a state to the FSM and uses it as the final state of a workflow.
 // it will only receive events if you returned FSMContext.Complete(...) and the workflow was unable to complete.
 // It also adds a DecisionErrorHandler to the state.
@@ -138,6 +208,44 @@ func (f *FSM) DefaultCompleteState() *FSMState {
 	}
 }
 
+// DefaultCancelState is the cancel state used in an FSM if one has not been set.
+// It waits for the outstanding activities and timers to settle, then responds with a CancelWorkflowExecution decision.
+func (f *FSM) DefaultCancelState() *FSMState {
+	return &FSMState{
+		Name: CancelState,
+		Decider: func(fsm *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			if outstanding := fsm.eventCorrelator.Outstanding(h); outstanding > 0 {
+				f.clog(fsm, "state=cancel at=await-outstanding outstanding=%d", outstanding)
+				return fsm.Stay(data, fsm.EmptyDecisions())
+			}
+			f.clog(fsm, "state=cancel at=attempt-cancellation event=%s", *h.EventType)
+			return fsm.CancelWorkflow(data)
+		},
+	}
+}
+
+// DefaultErrorState is the error state used in an FSM if one has not been set.
+// It waits for a RepairState signal, which replaces the state data with the signal input, if there is one,
+// and moves the workflow back to the state it failed in. The events that failed are not decided again.
+func (f *FSM) DefaultErrorState() *FSMState {
+	return &FSMState{
+		Name: ErrorState,
+		Decider: func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			failed := ctx.ErrorInfo()
+			if failed == nil || *h.EventType != swf.EventTypeWorkflowExecutionSignaled ||
+				*h.WorkflowExecutionSignaledEventAttributes.SignalName != RepiarStateSignal {
+				f.clog(ctx, "state=error at=awaiting-repair event=%s", *h.EventType)
+				return ctx.Stay(data, ctx.EmptyDecisions())
+			}
+			if input := h.WorkflowExecutionSignaledEventAttributes.Input; input != nil && *input != "" {
+				ctx.EventData(h, data)
+			}
+			f.clog(ctx, "state=error at=repaired next-state=%s", failed.StateName)
+			return ctx.Goto(failed.StateName, data, ctx.EmptyDecisions())
+		},
+	}
+}
+
 // DefaultDecisionErrorHandler is the DefaultDecisionErrorHandler
 func (f *FSM) DefaultDecisionErrorHandler(ctx *FSMContext, event swf.HistoryEvent, stateBeforeEvent interface{}, stateAfterError interface{}, err error) (*Outcome, error) {
 	f.log("action=tick workflow=%s workflow-id=%s at=decider-error err=%q", ctx.WorkflowType.Name, ctx.WorkflowID, err)
@@ -181,6 +289,26 @@ func (f *FSM) Init() {
 		f.AddCompleteState(f.DefaultCompleteState())
 	}
 
+	if f.cancelState == nil {
+		f.AddCancelState(f.DefaultCancelState())
+	}
+
+	if _, ok := f.states[ErrorState]; !ok && f.ErrorRecovery != nil {
+		f.AddState(f.DefaultErrorState())
+	}
+
+	for _, state := range f.states {
+		if state.Parent == "" {
+			continue
+		}
+		if _, ok := f.states[state.Parent]; !ok {
+			panic(fmt.Sprintf("Parent %s Of State %s Is Not In FSM", state.Parent, state.Name))
+		}
+		if f.inState(f.states[state.Parent], state.Name) {
+			panic(fmt.Sprintf("State %s Is Its Own Parent", state.Name))
+		}
+	}
+
 	if f.stop == nil {
 		f.stop = make(chan bool, 1)
 	}
@@ -194,9 +322,13 @@ func (f *FSM) Init() {
 		f.Serializer = &JSONStateSerializer{}
 	}
 
-	if f.systemSerializer == nil {
-		f.log("action=start at=no-system-serializer defaulting-to=JSONSerializer")
-		f.systemSerializer = &JSONStateSerializer{}
+	if f.SystemSerializer == nil {
+		f.log("action=start at=no-system-serializer defaulting-to=MarkerSerializer")
+		f.SystemSerializer = &MarkerSerializer{}
+	}
+
+	if f.DataCopier == nil {
+		f.DataCopier = SerializingDataCopier(f.Serializer)
 	}
 
 	if f.ShutdownManager == nil {
@@ -254,6 +386,15 @@ func (f *FSM) handleDecisionTask(decisionTask *swf.DecisionTask) {
 		}
 	}
 
+	//cached after replication, as the next decision task of the workflow can take the data and correlator from the cache and change them
+	if f.StateCache != nil {
+		f.StateCache.Put(f.stateCacheKey(decisionTask, state), &CachedState{
+			StateName:  state.StateName,
+			Data:       context.stateData,
+			Correlator: context.eventCorrelator,
+		})
+	}
+
 }
 
 // Serialize uses the FSM.Serializer to serialize data to a string.
@@ -282,6 +423,11 @@ func (f *FSM) Deserialize(serialized string, data interface{}) {
 // On errors, a nil *SerializedState is returned, and an error Outcome is included in the Decision list.
 // It is exported to facilitate testing.
 func (f *FSM) Tick(decisionTask *swf.DecisionTask) (*FSMContext, []swf.Decision, *SerializedState, error) {
+	return f.tick(decisionTask, false)
+}
+
+// tick is Tick. When recovering it is replaying the events of an error state, so errors are returned without applying the ErrorRecovery policy.
+func (f *FSM) tick(decisionTask *swf.DecisionTask, recovering bool) (*FSMContext, []swf.Decision, *SerializedState, error) {
 	//BeforeDecision interceptor invocation
 	if f.DecisionInterceptor != nil {
 		f.DecisionInterceptor.BeforeTask(decisionTask)
@@ -303,26 +449,47 @@ func (f *FSM) Tick(decisionTask *swf.DecisionTask) (*FSMContext, []swf.Decision,
 		}
 		return nil, nil, nil, errors.Trace(err)
 	}
-	eventCorrelator, err := f.findSerializedEventCorrelator(decisionTask.Events)
-	if err != nil {
-		f.FSMErrorReporter.ErrorFindingCorrelator(decisionTask, err)
-		if f.allowPanics {
-			panic(err)
+	var cached *CachedState
+	if f.StateCache != nil {
+		cached = f.StateCache.Take(f.stateCacheKey(decisionTask, serializedState))
+		if cached != nil && cached.StateName != serializedState.StateName {
+			cached = nil
+		}
+	}
+
+	var eventCorrelator *EventCorrelator
+	if cached != nil {
+		eventCorrelator = cached.Correlator
+	} else {
+		eventCorrelator, err = f.findSerializedEventCorrelator(decisionTask.Events)
+		if err != nil {
+			f.FSMErrorReporter.ErrorFindingCorrelator(decisionTask, err)
+			if f.allowPanics {
+				panic(err)
+			}
+			return nil, nil, nil, errors.Trace(err)
 		}
-		return nil, nil, nil, errors.Trace(err)
 	}
 	context.eventCorrelator = eventCorrelator
+	context.started = findStarted(decisionTask.Events)
+	context.history = decisionTask.Events
 
 	f.clog(context, "action=tick at=find-serialized-state state=%s", serializedState.StateName)
 
 	if outcome.Data == nil && outcome.State == "" {
-		data := f.zeroStateData()
-		if err = f.Serializer.Deserialize(serializedState.StateData, data); err != nil {
-			f.FSMErrorReporter.ErrorDeserializingStateData(decisionTask, serializedState.StateData, err)
-			if f.allowPanics {
-				panic(err)
+		var data interface{}
+		if cached != nil {
+			data = cached.Data
+			f.clog(context, "action=tick at=state-cache-hit version=%d", serializedState.StateVersion)
+		} else {
+			data = f.zeroStateData()
+			if err = f.deserializeStateData(serializedState, data); err != nil {
+				f.FSMErrorReporter.ErrorDeserializingStateData(decisionTask, serializedState.StateData, err)
+				if f.allowPanics {
+					panic(err)
+				}
+				return nil, nil, nil, errors.Trace(err)
 			}
-			return nil, nil, nil, errors.Trace(err)
 		}
 		f.clog(context, "action=tick at=find-current-data data=%v", data)
 		outcome.Data = data
@@ -338,58 +505,132 @@ func (f *FSM) Tick(decisionTask *swf.DecisionTask) (*FSMContext, []swf.Decision,
 		}
 	}
 
+	//the first event that is decided again if this decision task fails
+	earliest := *decisionTask.PreviousStartedEventID + 1
 	errorState, err := f.findSerializedErrorState(decisionTask.Events)
-	if errorState != nil {
+	if errorState != nil && outcome.State == ErrorState {
+		//the workflow was moved to the error state by the ErrorRecovery policy, and waits there to be repaired
+		context.errorState = errorState
+	} else if errorState != nil {
 		recovery, err := f.ErrorStateTick(decisionTask, errorState, context, outcome.Data)
 		if recovery != nil {
 			outcome = recovery
+			eventCorrelator = context.eventCorrelator
+			earliest = errorState.EarliestUnprocessedEventID
 		} else {
 			logf(context, "at=error error=error-recovery-failed cause=%s", err)
 			//bump the unprocessed window, and re-record the error marker
 			errorState.LatestUnprocessedEventID = *decisionTask.StartedEventID
-			final, serializedState, err := f.recordStateMarkers(context.stateVersion, outcome, eventCorrelator, errorState)
 			//update Error State Marker and exit with 3 marker decisions
-			return context, final, serializedState, err
+			recorded, final, serializedState, err := f.recordErrorState(decisionTask, context, outcome, errorState, err, recovering)
+			if final == nil {
+				return nil, nil, nil, err
+			}
+			//the task completes with the widened window, rather than being redelivered while the error persists
+			return recorded, final, serializedState, nil
+		}
+	}
+
+	//start the timers the previous run had open again, when this is the start of a continued run
+	rearmed, err := f.rearmContinuedTimers(lastEvents)
+	if err != nil {
+		f.FSMErrorReporter.ErrorFindingCorrelator(decisionTask, err)
+		if f.allowPanics {
+			panic(err)
 		}
+		return nil, nil, nil, errors.Trace(err)
+	}
+	for _, d := range rearmed {
+		context.timerStarted(*d.StartTimerDecisionAttributes.TimerID)
+	}
+	outcome.Decisions = append(outcome.Decisions, rearmed...)
+
+	//if a close decision failed, decide the new events in the state that made it, and retry it when the failure is reached
+	retryClose := f.shouldRetryClose(context, lastEvents)
+	if retryClose {
+		f.clog(context, "action=tick at=close-decision-failed closed-by=%s attempts=%d", eventCorrelator.Close.State, eventCorrelator.Close.Attempts)
+		outcome.State = eventCorrelator.Close.State
 	}
+	var closing *CloseInfo
 
 	//iterate through events oldest to newest, calling the decider for the current state.
-	//if the outcome changes the state use the right FSMState
+	//if the outcome changes the state use the right FSMState, and replay any stashed events through it before the next event
+	pending := make([]swf.HistoryEvent, 0, len(lastEvents))
 	for i := len(lastEvents) - 1; i >= 0; i-- {
-		e := lastEvents[i]
+		pending = append(pending, lastEvents[i])
+	}
+	for len(pending) > 0 {
+		e := pending[0]
+		pending = pending[1:]
 		f.clog(context, "action=tick at=history id=%d type=%s", *e.EventID, *e.EventType)
 		fsmState, ok := f.states[outcome.State]
 		if ok {
 			context.State = outcome.State
 			context.stateData = outcome.Data
 			//stash a copy of the state before the decision in case we need to call the error handler
-			stashed := f.Serialize(outcome.Data)
-			anOutcome, err := f.panicSafeDecide(fsmState, context, e, outcome.Data)
+			stashedData, err := f.copyData(outcome.Data)
 			if err != nil {
-				stashedData := f.zeroStateData()
-				f.Deserialize(stashed, stashedData)
-				handler := f.errorHandlers[fsmState.Name]
-				if handler == nil {
-					handler = f.DecisionErrorHandler
+				f.FSMErrorReporter.ErrorSerializingStateData(decisionTask, *outcome, *eventCorrelator, err)
+				if f.allowPanics {
+					panic(err)
+				}
+				return nil, nil, nil, errors.Trace(err)
+			}
+			if f.isStateTimeout(e) {
+				//the correlator tracks the timer firing, and the decider gets the synthetic timeout event, or nothing if the timer is stale
+				context.eventCorrelator.Track(e)
+				if !f.inState(fsmState, strings.TrimPrefix(*e.TimerFiredEventAttributes.TimerID, StateTimeoutTimer+".")) {
+					f.clog(context, "action=tick at=stale-state-timeout timer-id=%s", *e.TimerFiredEventAttributes.TimerID)
+					continue
+				}
+				e.EventType = aws.String(StateTimeoutEvent)
+			}
+			if f.isErrorRetryTimer(e) {
+				//retry timers only start a decision task, which retries the error state if there is one
+				context.eventCorrelator.Track(e)
+				continue
+			}
+			var anOutcome, entered Outcome
+			if retryClose && f.isCloseDecisionFailed(e) {
+				if hasCloseDecision(outcome.Decisions) {
+					f.clog(context, "action=tick at=skip-close-retry reason=already-closed")
+					context.eventCorrelator.Track(e)
+					continue
 				}
+				closing = context.eventCorrelator.Close
+				anOutcome, err = f.panicSafe(func() Outcome { return context.Decide(e, outcome.Data, f.closeDecisionFailed) })
+			} else {
+				entered, err = f.enterInitialState(fsmState, context, e, outcome.Data)
+				if err == nil {
+					anOutcome, err = f.panicSafeDecide(fsmState, context, e, entered.Data)
+				}
+				if err == nil && hasCloseDecision(anOutcome.Decisions) {
+					closing = &CloseInfo{State: fsmState.Name}
+				}
+			}
+			if err == nil {
+				decided := append(outcome.Decisions[:len(outcome.Decisions):len(outcome.Decisions)], entered.Decisions...)
+				anOutcome, err = f.transition(fsmState, context, e, anOutcome, decided)
+				anOutcome.Decisions = append(entered.Decisions, anOutcome.Decisions...)
+			}
+			if err != nil {
+				handler := f.errorHandler(fsmState.Name)
 				rescued, notRescued := handler(context, e, stashedData, outcome.Data, err)
 				if rescued != nil {
 					anOutcome = *rescued
 				} else {
 					errorState := &SerializedErrorState{
 						ErrorEvent:                 e,
-						EarliestUnprocessedEventID: *decisionTask.PreviousStartedEventID + 1,
+						EarliestUnprocessedEventID: earliest,
 						LatestUnprocessedEventID:   *decisionTask.StartedEventID,
+						StateName:                  fsmState.Name,
 					}
-					final, serializedState, err := f.recordStateMarkers(context.stateVersion, outcome, eventCorrelator, errorState)
+					//the events are decided again from the state before them, so the ones before the error are not lost
+					before, err := f.unprocessedOutcome(context, decisionTask, serializedState)
 					if err != nil {
-						f.FSMErrorReporter.ErrorSerializingStateData(decisionTask, *outcome, *eventCorrelator, err)
-						if f.allowPanics {
-							panic(err)
-						}
 						return nil, nil, nil, errors.Trace(err)
 					}
-					return context, final, serializedState, notRescued
+					return f.recordErrorState(decisionTask, context, before, errorState, notRescued, recovering)
 				}
 			}
 			//NOTE this call is handled in fsmContext.Decide. The double call causes nil panics
@@ -397,6 +638,9 @@ func (f *FSM) Tick(decisionTask *swf.DecisionTask) (*FSMContext, []swf.Decision,
 			curr := outcome.State
 			f.mergeOutcomes(outcome, anOutcome)
 			f.clog(context, "action=tick at=decided-event state=%s next-state=%s decisions=%d", curr, outcome.State, len(anOutcome.Decisions))
+			if outcome.State != curr {
+				pending = append(f.unstash(context), pending...)
+			}
 		} else {
 			f.FSMErrorReporter.ErrorMissingFSMState(decisionTask, *outcome)
 			return nil, nil, nil, errors.New("marked-state-not-in-fsm state=" + outcome.State)
@@ -417,7 +661,38 @@ func (f *FSM) Tick(decisionTask *swf.DecisionTask) (*FSMContext, []swf.Decision,
 		outcome.Data = after.Data
 	}
 
-	final, serializedState, err := f.recordStateMarkers(context.stateVersion, outcome, context.eventCorrelator, nil)
+	//fix the decisions SWF would reject, leaving room for the markers
+	//the state is serialized once, to size the room its markers need and to record them
+	nextState, nextStateDetails, serializeErr := f.serializeState(context.stateVersion, outcome)
+	reserved := reservedDecisions(outcome, nextStateDetails)
+	decisions, invalid := validateDecisions(outcome.Decisions, MaxDecisions-reserved)
+	if invalid != nil {
+		next, unprocessed, err := f.invalidDecisions(context, serializedState, decisionTask, lastEvents, outcome, errorState, invalid, MaxDecisions-reserved)
+		if unprocessed != nil {
+			return f.recordErrorState(decisionTask, context, next, unprocessed, err, recovering)
+		}
+		if err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		outcome = next
+		decisions = next.Decisions
+		nextState, nextStateDetails, serializeErr = f.serializeState(context.stateVersion, outcome)
+	}
+	outcome.Decisions = decisions
+
+	//all events were processed, so none of them will be decided again with the recorded side effects
+	context.eventCorrelator.clearSideEffects()
+	context.eventCorrelator.Close = f.closeInfo(context, closing, outcome)
+	//an error state is carried forward while the workflow waits in the error state
+	var carried *SerializedErrorState
+	if outcome.State == ErrorState {
+		carried = context.errorState
+	}
+	err = serializeErr
+	var final []swf.Decision
+	if err == nil {
+		final, err = f.recordSerializedStateMarkers(nextState, nextStateDetails, outcome, context.eventCorrelator, carried)
+	}
 	if err != nil {
 		f.FSMErrorReporter.ErrorSerializingStateData(decisionTask, *outcome, *eventCorrelator, err)
 		if f.allowPanics {
@@ -426,59 +701,493 @@ func (f *FSM) Tick(decisionTask *swf.DecisionTask) (*FSMContext, []swf.Decision,
 		return nil, nil, nil, errors.Trace(err)
 	}
 
-	return context, final, serializedState, nil
+	context.State = outcome.State
+	context.stateData = outcome.Data
+	return context, final, nextState, nil
 }
 
 // ErrorStateTick is called when the DecisionTaskPoller receives a PollForDecisionTaskResponse in its polling loop
 // that contains an error marker in its history.
+// Without an ErrorRecovery policy, the DecisionErrorHandler for the current state is called first, and the events are only
+// decided again if it returns an Outcome. With one, the events are always decided again.
+// The events decided again are the ones from the EarliestUnprocessedEventID to the LatestUnprocessedEventID.
 func (f *FSM) ErrorStateTick(decisionTask *swf.DecisionTask, error *SerializedErrorState, context *FSMContext, data interface{}) (*Outcome, error) {
-	handler := f.errorHandlers[context.State]
-	if handler == nil {
-		handler = f.DecisionErrorHandler
-	}
-	handled, notHandled := handler(context, error.ErrorEvent, data, data, nil)
-	if handled == nil {
-		return nil, notHandled
+	if f.ErrorRecovery == nil {
+		handler := f.errorHandler(context.State)
+		handled, notHandled := handler(context, error.ErrorEvent, data, data, nil)
+		if handled == nil {
+			return nil, notHandled
+		}
 	}
 
 	//todo we are assuming all history events in the range
 	//error.EarliestUnprocessedEventID to error.LatestUnprocessedEventID
 	//are in the decisionTaks.History
 	filteredDecisionTask := new(swf.DecisionTask)
-	s, e := f.systemSerializer.Serialize(decisionTask)
-	if e != nil {
-		return nil, e
-	}
-	e = f.systemSerializer.Deserialize(s, filteredDecisionTask)
-	if e != nil {
-		return nil, e
-	}
+	*filteredDecisionTask = *decisionTask
 
 	filtered := make([]swf.HistoryEvent, 0)
 	for _, h := range decisionTask.Events {
-		if f.isErrorMarker(h) {
+		//the correlator recorded with the error marker is kept, as it holds the side effects already run for the unprocessed events
+		if f.isErrorMarker(h) || (*h.EventID > error.LatestUnprocessedEventID && !f.isCorrelatorMarker(h)) {
 			continue
 		}
 		filtered = append(filtered, h)
 	}
+	//the error marker was recorded with the state from before the unprocessed events, so all of them are decided again
+	previousStarted := error.EarliestUnprocessedEventID - 1
 	filteredDecisionTask.Events = filtered
 	filteredDecisionTask.StartedEventID = &error.LatestUnprocessedEventID
-	filteredDecisionTask.PreviousStartedEventID = &error.EarliestUnprocessedEventID
+	filteredDecisionTask.PreviousStartedEventID = &previousStarted
 
-	_, decisions, serializedState, err := f.Tick(filteredDecisionTask)
+	recovered, decisions, serializedState, err := f.tick(filteredDecisionTask, true)
 	if err != nil {
-		data := f.zeroStateData()
-		f.Deserialize(serializedState.StateData, data)
+		if recovered != nil {
+			//the side effects run by the replay are recorded again with the error marker, so they do not run again
+			context.eventCorrelator.SideEffects = recovered.eventCorrelator.SideEffects
+		}
+		return nil, err
+	}
+
+	//the markers of the replay are recorded again by the decision task that is recovering
+	replayed := make([]swf.Decision, 0, len(decisions))
+	for _, d := range decisions {
+		if *d.DecisionType == swf.DecisionTypeRecordMarker {
+			name := *d.RecordMarkerDecisionAttributes.MarkerName
+			if name == StateMarker || name == CorrelatorMarker || strings.HasPrefix(name, StateChunkMarker) {
+				continue
+			}
+		}
+		replayed = append(replayed, d)
+	}
+	context.eventCorrelator = recovered.eventCorrelator
+	logf(context, "at=error-recovered replayed-from=%d replayed-to=%d", previousStarted+1, error.LatestUnprocessedEventID)
+	return &Outcome{
+		State:     serializedState.StateName,
+		Decisions: replayed,
+		Data:      recovered.stateData,
+	}, nil
+}
 
-		return &Outcome{
-			State:     serializedState.StateName,
-			Decisions: decisions,
-			Data:      data,
-		}, nil
+// recordErrorState records the markers for an error state, and returns them as the result of a decision task.
+// With an ErrorRecovery policy, a timer is started to retry the unprocessed events, or when the attempts are used up,
+// the workflow is moved to the ErrorState.
+func (f *FSM) recordErrorState(decisionTask *swf.DecisionTask, context *FSMContext, outcome *Outcome, errorState *SerializedErrorState, cause error, recovering bool) (*FSMContext, []swf.Decision, *SerializedState, error) {
+	policy := f.ErrorRecovery
+	if !recovering {
+		errorState.Attempts++
+		if errorState.StateName == "" {
+			errorState.StateName = outcome.State
+		}
+		describeError(errorState, cause)
+	}
+	var extra []swf.Decision
+	if policy != nil && !recovering {
+		if policy.MaxAttempts > 0 && errorState.Attempts >= policy.MaxAttempts {
+			logf(context, "at=error error=error-state-entered attempts=%d cause=%s", errorState.Attempts, cause)
+			context.errorState = errorState
+			decisions, data, err := f.enterErrorState(context, outcome.Data)
+			if err != nil {
+				return nil, nil, nil, errors.Trace(err)
+			}
+			extra = decisions
+			outcome.State = ErrorState
+			outcome.Data = data
+		} else {
+			backoff := policy.backoff(errorState.Attempts)
+			logf(context, "at=error error=error-retry-scheduled attempts=%d backoff=%s cause=%s", errorState.Attempts, backoff, cause)
+			extra = append(extra, swf.Decision{
+				DecisionType: aws.String(swf.DecisionTypeStartTimer),
+				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+					StartToFireTimeout: aws.String(strconv.Itoa(int(backoff.Seconds()))),
+					TimerID:            aws.String(ErrorRetryTimer + "." + strconv.Itoa(errorState.Attempts)),
+				},
+			})
+		}
+	}
 
+	final, serializedState, err := f.recordStateMarkers(context.stateVersion, outcome, context.eventCorrelator, errorState)
+	if err != nil {
+		f.FSMErrorReporter.ErrorSerializingStateData(decisionTask, *outcome, *context.eventCorrelator, err)
+		if f.allowPanics {
+			panic(err)
+		}
+		return nil, nil, nil, errors.Trace(err)
+	}
+	context.State = outcome.State
+	context.stateData = outcome.Data
+	if policy == nil || recovering {
+		return context, final, serializedState, cause
 	}
+	return context, append(final, extra...), serializedState, nil
+}
 
-	return nil, err
+// invalidDecisions is called when the decisions of a decision task have problems ValidateDecisions can not fix.
+// The DecisionErrorHandler of the state can rescue them with an Outcome that has valid decisions. Otherwise the state before
+// the decision task is returned, with an error state that leaves all of its events unprocessed, as if the first of them had failed.
+func (f *FSM) invalidDecisions(context *FSMContext, serializedState *SerializedState, decisionTask *swf.DecisionTask, lastEvents []swf.HistoryEvent, outcome *Outcome, errorState *SerializedErrorState, invalid error, limit int) (*Outcome, *SerializedErrorState, error) {
+	logf(context, "at=error error=invalid-decisions cause=%s", invalid)
+	before := f.zeroStateData()
+	if err := f.deserializeStateData(serializedState, before); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var first swf.HistoryEvent
+	if len(lastEvents) > 0 {
+		first = lastEvents[len(lastEvents)-1]
+	}
+
+	handler := f.errorHandler(outcome.State)
+	rescued, err := handler(context, first, before, outcome.Data, invalid)
+	if rescued != nil {
+		if rescued.Decisions, err = validateDecisions(rescued.Decisions, limit); err == nil {
+			return rescued, nil, nil
+		}
+	}
+	if err == nil {
+		err = invalid
+	}
+
+	//none of the events were processed, so the correlator goes back to the one recorded with the state
+	correlator, cerr := f.findSerializedEventCorrelator(decisionTask.Events)
+	if cerr != nil {
+		return nil, nil, errors.Trace(cerr)
+	}
+	correlator.SideEffects = context.eventCorrelator.SideEffects
+	context.eventCorrelator = correlator
+	if errorState != nil {
+		errorState.LatestUnprocessedEventID = *decisionTask.StartedEventID
+	} else {
+		errorState = &SerializedErrorState{
+			ErrorEvent:                 first,
+			EarliestUnprocessedEventID: *decisionTask.PreviousStartedEventID + 1,
+			LatestUnprocessedEventID:   *decisionTask.StartedEventID,
+		}
+	}
+	return &Outcome{State: serializedState.StateName, Data: before, Decisions: f.EmptyDecisions()}, errorState, err
+}
+
+// unprocessedOutcome returns the state recorded before the events of a decision task, and restores the correlator recorded with it,
+// so an error marker records the place the events are decided again from. The side effects run for the events are kept in the correlator.
+func (f *FSM) unprocessedOutcome(context *FSMContext, decisionTask *swf.DecisionTask, serializedState *SerializedState) (*Outcome, error) {
+	before := f.zeroStateData()
+	if err := f.deserializeStateData(serializedState, before); err != nil {
+		return nil, errors.Trace(err)
+	}
+	correlator, err := f.findSerializedEventCorrelator(decisionTask.Events)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	//the side effects already run for the events are kept, so they are not run again when the events are decided again
+	correlator.SideEffects = context.eventCorrelator.SideEffects
+	context.eventCorrelator = correlator
+	return &Outcome{State: serializedState.StateName, Data: before, Decisions: f.EmptyDecisions()}, nil
+}
+
+// describeError records the message, type and stack trace of the error that put a workflow in an error state.
+// The stack trace of a DecisionPanic is where the Decider panicked, and for other errors it is the trace of their annotations.
+func describeError(errorState *SerializedErrorState, err error) {
+	if err == nil {
+		return
+	}
+	errorState.ErrorMessage = err.Error()
+	errorState.ErrorType = fmt.Sprintf("%T", errors.Cause(err))
+	stack := errors.ErrorStack(err)
+	if p := findDecisionPanic(err); p != nil {
+		errorState.ErrorType = fmt.Sprintf("%T", p.Value)
+		stack = p.Stack
+	}
+	if len(stack) > MaxStackTraceSize {
+		stack = stack[:MaxStackTraceSize]
+	}
+	errorState.StackTrace = stack
+}
+
+// findDecisionPanic returns the DecisionPanic an error was annotated from, if there is one.
+func findDecisionPanic(err error) *DecisionPanic {
+	for err != nil {
+		if p, ok := err.(*DecisionPanic); ok {
+			return p
+		}
+		wrapper, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return nil
+		}
+		err = wrapper.Underlying()
+	}
+	return nil
+}
+
+// enterErrorState calls the OnErrorState hook, and signals the OperatorWorkflowID, when the ErrorRecovery policy moves a workflow to the ErrorState.
+func (f *FSM) enterErrorState(context *FSMContext, data interface{}) ([]swf.Decision, interface{}, error) {
+	decisions := f.EmptyDecisions()
+	policy := f.ErrorRecovery
+	if policy.OnErrorState != nil {
+		entered, err := f.panicSafe(func() Outcome { return context.run(context.errorState.ErrorEvent, data, policy.OnErrorState) })
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		decisions = append(decisions, entered.Decisions...)
+		data = entered.Data
+	}
+	if policy.OperatorWorkflowID != "" {
+		input, err := f.SystemSerializer.Serialize(*context.errorState)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		decisions = append(decisions, swf.Decision{
+			DecisionType: aws.String(swf.DecisionTypeSignalExternalWorkflowExecution),
+			SignalExternalWorkflowExecutionDecisionAttributes: &swf.SignalExternalWorkflowExecutionDecisionAttributes{
+				WorkflowID: aws.String(policy.OperatorWorkflowID),
+				SignalName: aws.String(ErrorSignal),
+				Input:      aws.String(input),
+				Control:    context.WorkflowID,
+			},
+		})
+	}
+	return decisions, data, nil
+}
+
+// decider returns the Decider for a state. For a state with a Parent, an Outcome without a State, like the one from FSMContext.Pass,
+// falls back to the Decider of the Parent, and so on up the hierarchy, collecting the decisions and data of each Decider.
+func (f *FSM) decider(state *FSMState) Decider {
+	if state.Parent == "" {
+		return state.Decider
+	}
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		decisions := ctx.EmptyDecisions()
+		for _, s := range append([]*FSMState{state}, f.parents(state)...) {
+			outcome := s.Decider(ctx, h, data)
+			decisions = append(decisions, outcome.Decisions...)
+			data = outcome.Data
+			if outcome.State != "" {
+				return Outcome{State: outcome.State, Data: data, Decisions: decisions}
+			}
+		}
+		return Outcome{State: "", Data: data, Decisions: decisions}
+	}
+}
+
+// Ancestors returns the names of the parents of a state, nearest first.
+func (f *FSM) Ancestors(state string) []string {
+	var names []string
+	if s, ok := f.states[state]; ok {
+		for _, parent := range f.parents(s) {
+			names = append(names, parent.Name)
+		}
+	}
+	return names
+}
+
+// parents returns the parents of a state, nearest first.
+func (f *FSM) parents(state *FSMState) []*FSMState {
+	var parents []*FSMState
+	for parent, ok := f.states[state.Parent]; ok && len(parents) < len(f.states); parent, ok = f.states[parent.Parent] {
+		parents = append(parents, parent)
+	}
+	return parents
+}
+
+// errorHandler returns the DecisionErrorHandler for a state, falling back to those of its parents, and then to the FSM.DecisionErrorHandler.
+func (f *FSM) errorHandler(state string) DecisionErrorHandler {
+	for _, name := range append([]string{state}, f.Ancestors(state)...) {
+		if handler := f.errorHandlers[name]; handler != nil {
+			return handler
+		}
+	}
+	return f.DecisionErrorHandler
+}
+
+// transition runs the OnExit and OnEnter hooks, and manages the state timeout timers, when a Decider's Outcome changes the state.
+// States are exited from the leaf up to, but not including, the closest parent shared with the next state, and entered from there down.
+// Decisions from OnExit are added before the Decider's decisions, and those from OnEnter after them, but before any decision that closes the workflow.
+// decided holds the decisions already made in this decision task.
+func (f *FSM) transition(from *FSMState, context *FSMContext, event swf.HistoryEvent, outcome Outcome, decided []swf.Decision) (Outcome, error) {
+	to, ok := f.states[outcome.State]
+	if outcome.State == "" || outcome.State == from.Name || !ok {
+		return outcome, nil
+	}
+	exited, entered := f.transitionPath(from, to)
+
+	var before, after []swf.Decision
+	for _, state := range exited {
+		if state.OnExit != nil {
+			hooked, err := f.panicSafe(func() Outcome { return context.run(event, outcome.Data, state.OnExit) })
+			if err != nil {
+				return outcome, errors.Trace(err)
+			}
+			before = append(before, hooked.Decisions...)
+			outcome.Data = hooked.Data
+		}
+		if state.Timeout > 0 && f.stateTimeoutStarted(state, context, decided, outcome.Decisions) {
+			after = append(after, swf.Decision{
+				DecisionType:                  aws.String(swf.DecisionTypeCancelTimer),
+				CancelTimerDecisionAttributes: &swf.CancelTimerDecisionAttributes{TimerID: aws.String(stateTimeoutTimerID(state.Name))},
+			})
+		}
+	}
+
+	context.State = to.Name
+	defer func() { context.State = from.Name }()
+	hooked, err := f.enter(entered, context, event, outcome.Data)
+	if err != nil {
+		return outcome, errors.Trace(err)
+	}
+	after = append(after, hooked.Decisions...)
+	outcome.Data = hooked.Data
+
+	decisions := append(before, outcome.Decisions...)
+	closing := len(decisions)
+	for closing > 0 && isCloseDecision(decisions[closing-1]) {
+		closing--
+	}
+	outcome.Decisions = append(append(decisions[:closing:closing], after...), decisions[closing:]...)
+	return outcome, nil
+}
+
+// enter calls the OnEnter of the states entered, outermost first, and starts the timers of their Timeout.
+func (f *FSM) enter(entered []*FSMState, context *FSMContext, event swf.HistoryEvent, data interface{}) (Outcome, error) {
+	outcome := Outcome{Data: data, Decisions: f.EmptyDecisions()}
+	for _, state := range entered {
+		if state.OnEnter != nil {
+			hooked, err := f.panicSafe(func() Outcome { return context.run(event, outcome.Data, state.OnEnter) })
+			if err != nil {
+				return outcome, errors.Trace(err)
+			}
+			outcome.Decisions = append(outcome.Decisions, hooked.Decisions...)
+			outcome.Data = hooked.Data
+		}
+		if state.Timeout > 0 {
+			outcome.Decisions = append(outcome.Decisions, swf.Decision{
+				DecisionType: aws.String(swf.DecisionTypeStartTimer),
+				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+					StartToFireTimeout: aws.String(strconv.Itoa(int(state.Timeout.Seconds()))),
+					TimerID:            aws.String(stateTimeoutTimerID(state.Name)),
+					Control:            aws.String(state.Name),
+				},
+			})
+		}
+	}
+	return outcome, nil
+}
+
+// enterInitialState enters the initial state, and its parents, when a new workflow starts, so their OnEnter and Timeout
+// apply as they do to the states a workflow moves to. Continued runs are already in their state, and carry over its timers.
+func (f *FSM) enterInitialState(state *FSMState, context *FSMContext, event swf.HistoryEvent, data interface{}) (Outcome, error) {
+	if *event.EventType != swf.EventTypeWorkflowExecutionStarted || event.WorkflowExecutionStartedEventAttributes.ContinuedExecutionRunID != nil ||
+		state.Name != f.initialState.Name {
+		return Outcome{Data: data}, nil
+	}
+	parents := f.parents(state)
+	entered := make([]*FSMState, 0, len(parents)+1)
+	for i := len(parents) - 1; i >= 0; i-- {
+		entered = append(entered, parents[i])
+	}
+	return f.enter(append(entered, state), context, event, data)
+}
+
+// transitionPath returns the states exited, leaf first, and the states entered, outermost first, when moving between two states.
+func (f *FSM) transitionPath(from *FSMState, to *FSMState) ([]*FSMState, []*FSMState) {
+	toPath := append([]*FSMState{to}, f.parents(to)...)
+	shared := make(map[string]bool)
+	for _, state := range toPath {
+		shared[state.Name] = true
+	}
+
+	var exited []*FSMState
+	common := ""
+	for _, state := range append([]*FSMState{from}, f.parents(from)...) {
+		if shared[state.Name] {
+			common = state.Name
+			break
+		}
+		exited = append(exited, state)
+	}
+
+	var entered []*FSMState
+	for i := len(toPath) - 1; i >= 0; i-- {
+		if toPath[i].Name == common {
+			entered = nil
+			continue
+		}
+		entered = append(entered, toPath[i])
+	}
+	return exited, entered
+}
+
+// stateTimeoutStarted is true if the timeout timer of a state is open, or was started by decisions made in this decision task.
+func (f *FSM) stateTimeoutStarted(state *FSMState, context *FSMContext, decided ...[]swf.Decision) bool {
+	timerID := stateTimeoutTimerID(state.Name)
+	for _, info := range context.eventCorrelator.Timers {
+		if info.TimerID == timerID {
+			return true
+		}
+	}
+	started := false
+	for _, decisions := range decided {
+		for _, d := range decisions {
+			switch *d.DecisionType {
+			case swf.DecisionTypeStartTimer:
+				if *d.StartTimerDecisionAttributes.TimerID == timerID {
+					started = true
+				}
+			case swf.DecisionTypeCancelTimer:
+				if *d.CancelTimerDecisionAttributes.TimerID == timerID {
+					started = false
+				}
+			}
+		}
+	}
+	return started
+}
+
+// inState is true if name is the state, or one of its parents.
+func (f *FSM) inState(state *FSMState, name string) bool {
+	if state.Name == name {
+		return true
+	}
+	for _, parent := range f.parents(state) {
+		if parent.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func stateTimeoutTimerID(state string) string {
+	return StateTimeoutTimer + "." + state
+}
+
+func hasCloseDecision(decisions []swf.Decision) bool {
+	return len(decisions) > 0 && isCloseDecision(decisions[len(decisions)-1])
+}
+
+func isCloseDecision(d swf.Decision) bool {
+	switch *d.DecisionType {
+	case swf.DecisionTypeCompleteWorkflowExecution, swf.DecisionTypeFailWorkflowExecution,
+		swf.DecisionTypeCancelWorkflowExecution, swf.DecisionTypeContinueAsNewWorkflowExecution:
+		return true
+	}
+	return false
+}
+
+// unstash takes the events stashed by FSMContext.Stash, dropping those older than the StashExpiry, so they can be replayed.
+func (f *FSM) unstash(context *FSMContext) []swf.HistoryEvent {
+	stashed := context.eventCorrelator.unstash()
+	if len(stashed) == 0 || f.StashExpiry == 0 {
+		return stashed
+	}
+	now := context.Now()
+	unexpired := make([]swf.HistoryEvent, 0, len(stashed))
+	for _, e := range stashed {
+		if e.EventTimestamp != nil && e.EventTimestamp.Time.Add(f.StashExpiry).Before(now) {
+			f.clog(context, "action=tick at=stash-expired id=%d type=%s", *e.EventID, *e.EventType)
+			continue
+		}
+		unexpired = append(unexpired, e)
+	}
+	return unexpired
 }
 
 func (f *FSM) mergeOutcomes(final *Outcome, intermediate Outcome) {
@@ -489,57 +1198,134 @@ func (f *FSM) mergeOutcomes(final *Outcome, intermediate Outcome) {
 	}
 }
 
-func (f *FSM) panicSafeDecide(state *FSMState, context *FSMContext, event swf.HistoryEvent, data interface{}) (anOutcome Outcome, anErr error) {
+func (f *FSM) panicSafeDecide(state *FSMState, context *FSMContext, event swf.HistoryEvent, data interface{}) (Outcome, error) {
+	decider := f.decider(state)
+	if f.isManagedCancelRequest(state, event) {
+		decider = f.cancelRequested
+	}
+	return f.panicSafe(func() Outcome { return context.Decide(event, data, decider) })
+}
+
+// isManagedCancelRequest is true for a WorkflowExecutionCancelRequested event that starts the managed cancellation, see FSM.OnCancelRequested.
+func (f *FSM) isManagedCancelRequest(state *FSMState, event swf.HistoryEvent) bool {
+	return f.OnCancelRequested != nil && f.cancelState != nil && state != f.cancelState &&
+		*event.EventType == swf.EventTypeWorkflowExecutionCancelRequested
+}
+
+// cancelRequested is the Decider for the event that starts the managed cancellation. It calls OnCancelRequested, requests cancellation of
+// the outstanding activities and timers, and moves to the cancel state, cancelling the workflow right away if nothing is outstanding.
+func (f *FSM) cancelRequested(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+	requested := f.OnCancelRequested(ctx, h, data)
+	decisions := append(ctx.EmptyDecisions(), requested.Decisions...)
+	for _, key := range sortedKeys(ctx.eventCorrelator.Activities) {
+		info := ctx.eventCorrelator.Activities[key]
+		decisions = append(decisions, swf.Decision{
+			DecisionType: aws.String(swf.DecisionTypeRequestCancelActivityTask),
+			RequestCancelActivityTaskDecisionAttributes: &swf.RequestCancelActivityTaskDecisionAttributes{
+				ActivityID: aws.String(info.ActivityID),
+			},
+		})
+	}
+	for _, key := range sortedKeys(ctx.eventCorrelator.Timers) {
+		info := ctx.eventCorrelator.Timers[key]
+		//state timeout timers are cancelled by the transition to the cancel state
+		if strings.HasPrefix(info.TimerID, StateTimeoutTimer+".") {
+			continue
+		}
+		decisions = append(decisions, swf.Decision{
+			DecisionType:                  aws.String(swf.DecisionTypeCancelTimer),
+			CancelTimerDecisionAttributes: &swf.CancelTimerDecisionAttributes{TimerID: aws.String(info.TimerID)},
+		})
+	}
+	f.clog(ctx, "action=tick at=cancel-requested outstanding=%d", len(decisions)-len(requested.Decisions))
+	//timers are cancelled as soon as these decisions are, so only activities need to be waited for
+	if len(ctx.eventCorrelator.Activities) == 0 {
+		decisions = append(decisions, ctx.CancelWorkflowDecision(requested.Data))
+	}
+	return ctx.Goto(f.cancelState.Name, requested.Data, decisions)
+}
+
+// shouldRetryClose is true if the events include a failed close decision that the FSM should retry.
+func (f *FSM) shouldRetryClose(context *FSMContext, events []swf.HistoryEvent) bool {
+	closed := context.eventCorrelator.Close
+	if closed == nil {
+		return false
+	}
+	max := f.MaxCloseDecisionRetries
+	if max == 0 {
+		max = DefaultCloseDecisionRetries
+	}
+	if closed.Attempts >= max {
+		f.clog(context, "action=tick at=close-decision-retries-exhausted attempts=%d", closed.Attempts)
+		return false
+	}
+	if _, ok := f.states[closed.State]; !ok {
+		return false
+	}
+	for _, e := range events {
+		if f.isCloseDecisionFailed(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeDecisionFailed is the Decider for a failed close decision that is being retried.
+func (f *FSM) closeDecisionFailed(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+	if f.OnCloseDecisionFailed != nil {
+		return f.OnCloseDecisionFailed(ctx, h, data)
+	}
+	return ctx.RetryCloseDecision(data)
+}
+
+// closeInfo records the close decision made in a decision task, if there is one, so it can be retried if it fails.
+func (f *FSM) closeInfo(context *FSMContext, closing *CloseInfo, outcome *Outcome) *CloseInfo {
+	if closing == nil || !hasCloseDecision(outcome.Decisions) {
+		return nil
+	}
+	d := outcome.Decisions[len(outcome.Decisions)-1]
+	info := &CloseInfo{
+		DecisionType: *d.DecisionType,
+		State:        closing.State,
+		NextState:    outcome.State,
+	}
+	if closing.DecisionType != "" {
+		//this is a retry, so count it
+		info.Attempts = closing.Attempts + 1
+	}
+	switch *d.DecisionType {
+	case swf.DecisionTypeFailWorkflowExecution:
+		if reason := d.FailWorkflowExecutionDecisionAttributes.Reason; reason != nil {
+			info.Reason = *reason
+		}
+		if details := d.FailWorkflowExecutionDecisionAttributes.Details; details != nil {
+			info.Details = *details
+		}
+	case swf.DecisionTypeContinueAsNewWorkflowExecution:
+		continued := new(continuation)
+		if input := d.ContinueAsNewWorkflowExecutionDecisionAttributes.Input; input != nil && f.Serializer.Deserialize(*input, continued) == nil {
+			info.ContinuedState = continued.StateName
+		}
+	}
+	return info
+}
+
+// panicSafe calls a func that runs a Decider or a state hook, recovering from panics unless allowPanics is set.
+func (f *FSM) panicSafe(decide func() Outcome) (anOutcome Outcome, anErr error) {
 	defer func() {
 		if !f.allowPanics {
 			if r := recover(); r != nil {
 				f.log("at=error error=decide-panic-recovery %v", r)
-				if err, ok := r.(error); ok && err != nil {
-					anErr = errors.Trace(err)
-				} else {
-					anErr = errors.New("panic in decider, null error, capture error state")
-				}
+				anErr = errors.Trace(&DecisionPanic{Value: r, Stack: string(debug.Stack())})
 			}
 		} else {
 			log.Printf("at=panic-safe-decide-allowing-panic fsm-allow-panics=%t", f.allowPanics)
 		}
 	}()
-	anOutcome = context.Decide(event, data, state.Decider)
+	anOutcome = decide()
 	return
 }
 
-// EventData works in combination with the FSM.Serializer to provide
-// deserialization of data sent in a HistoryEvent. It is sugar around extracting the event payload from the proper
-// field of the proper Attributes struct on the HistoryEvent
-func (f *FSM) EventData(event swf.HistoryEvent, eventData interface{}) {
-
-	if eventData != nil {
-		var serialized string
-		switch *event.EventType {
-		case swf.EventTypeActivityTaskCompleted:
-			serialized = *event.ActivityTaskCompletedEventAttributes.Result
-		case swf.EventTypeChildWorkflowExecutionFailed:
-			serialized = *event.ActivityTaskFailedEventAttributes.Details
-		case swf.EventTypeWorkflowExecutionCompleted:
-			serialized = *event.WorkflowExecutionCompletedEventAttributes.Result
-		case swf.EventTypeChildWorkflowExecutionCompleted:
-			serialized = *event.ChildWorkflowExecutionCompletedEventAttributes.Result
-		case swf.EventTypeWorkflowExecutionSignaled:
-			serialized = *event.WorkflowExecutionSignaledEventAttributes.Input
-		case swf.EventTypeWorkflowExecutionStarted:
-			serialized = *event.WorkflowExecutionStartedEventAttributes.Input
-		case swf.EventTypeWorkflowExecutionContinuedAsNew:
-			serialized = *event.WorkflowExecutionContinuedAsNewEventAttributes.Input
-		}
-		if serialized != "" {
-			f.Deserialize(serialized, eventData)
-		} else {
-			panic(fmt.Sprintf("event payload was empty for %s", s.PrettyHistoryEvent(event)))
-		}
-	}
-
-}
-
 func (f *FSM) log(format string, data ...interface{}) {
 	actualFormat := fmt.Sprintf("component=FSM name=%s %s", f.Name, format)
 	log.Printf(actualFormat, data...)
@@ -551,10 +1337,18 @@ func (f *FSM) clog(ctx *FSMContext, format string, data ...interface{}) {
 }
 
 func (f *FSM) findSerializedState(events []swf.HistoryEvent) (*SerializedState, error) {
-	for _, event := range events {
+	for i, event := range events {
 		if f.isStateMarker(event) {
+			details := *event.MarkerRecordedEventAttributes.Details
+			if strings.HasPrefix(details, stateChunksPrefix) {
+				joined, err := f.joinStateChunks(details, events[i+1:])
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				details = joined
+			}
 			state := &SerializedState{}
-			err := f.systemSerializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, state)
+			err := f.SystemSerializer.Deserialize(details, state)
 			return state, err
 		} else if *event.EventType == swf.EventTypeWorkflowExecutionStarted {
 			state := &SerializedState{}
@@ -568,8 +1362,9 @@ func (f *FSM) findSerializedState(events []swf.HistoryEvent) (*SerializedState,
 				}
 				return state, err
 			}
-			//Otherwise we expect just a stateData struct
+			//Otherwise we expect just a stateData struct, in the current schema
 			state.StateVersion = 0
+			state.DataVersion = f.DataVersion
 			state.StateName = f.initialState.Name
 			state.StateData = *event.WorkflowExecutionStartedEventAttributes.Input
 			return state, nil
@@ -578,22 +1373,109 @@ func (f *FSM) findSerializedState(events []swf.HistoryEvent) (*SerializedState,
 	return nil, errors.New("Cant Find Current Data")
 }
 
+// joinStateChunks reassembles a state marker that was split across numbered chunk markers.
+// The chunks were recorded just before the state marker, so with the history in reverse order they follow it.
+func (f *FSM) joinStateChunks(header string, events []swf.HistoryEvent) (string, error) {
+	count, err := strconv.Atoi(strings.TrimPrefix(header, stateChunksPrefix))
+	if err != nil {
+		return "", errors.Annotatef(err, "bad state chunk header %q", header)
+	}
+	chunks := make([]string, count)
+	found := 0
+	for _, event := range events {
+		if found == count {
+			break
+		}
+		if !f.isStateChunkMarker(event) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(*event.MarkerRecordedEventAttributes.MarkerName, StateChunkMarker))
+		if err != nil || n < 1 || n > count || chunks[n-1] != "" {
+			continue
+		}
+		chunks[n-1] = *event.MarkerRecordedEventAttributes.Details
+		found++
+	}
+	if found != count {
+		return "", errors.Errorf("state marker is missing chunks found=%d expected=%d", found, count)
+	}
+	return strings.Join(chunks, ""), nil
+}
+
 func (f *FSM) findSerializedEventCorrelator(events []swf.HistoryEvent) (*EventCorrelator, error) {
 	for _, event := range events {
 		if f.isCorrelatorMarker(event) {
 			correlator := &EventCorrelator{}
-			err := f.Serializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, correlator)
+			err := f.SystemSerializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, correlator)
 			return correlator, err
+		} else if *event.EventType == swf.EventTypeWorkflowExecutionStarted &&
+			event.WorkflowExecutionStartedEventAttributes.ContinuedExecutionRunID != nil {
+			//carry over what the previous run put in the continuation
+			continued := &continuation{}
+			if err := f.Serializer.Deserialize(*event.WorkflowExecutionStartedEventAttributes.Input, continued); err != nil {
+				return nil, errors.Trace(err)
+			}
+			return &EventCorrelator{
+				Versions:         continued.Versions,
+				ActivityAttempts: continued.ActivityAttempts,
+				SignalAttempts:   continued.SignalAttempts,
+				Groups:           continued.Groups,
+				Fired:            continued.Fired,
+			}, nil
 		}
 	}
 	return &EventCorrelator{}, nil
 }
 
+// rearmContinuedTimers returns StartTimer decisions for the timers a previous run had open when it continued,
+// if the WorkflowExecutionStarted event of a continued run is among the events being decided.
+func (f *FSM) rearmContinuedTimers(events []swf.HistoryEvent) ([]swf.Decision, error) {
+	for _, event := range events {
+		if *event.EventType != swf.EventTypeWorkflowExecutionStarted || event.WorkflowExecutionStartedEventAttributes.ContinuedExecutionRunID == nil {
+			continue
+		}
+		continued := &continuation{}
+		if err := f.Serializer.Deserialize(*event.WorkflowExecutionStartedEventAttributes.Input, continued); err != nil {
+			return nil, errors.Trace(err)
+		}
+		decisions := make([]swf.Decision, 0, len(continued.Timers))
+		for _, timer := range continued.Timers {
+			d := swf.Decision{
+				DecisionType: aws.String(swf.DecisionTypeStartTimer),
+				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+					StartToFireTimeout: aws.String(strconv.FormatInt(timer.Remaining, 10)),
+					TimerID:            aws.String(timer.TimerID),
+				},
+			}
+			if timer.Control != "" {
+				d.StartTimerDecisionAttributes.Control = aws.String(timer.Control)
+			}
+			decisions = append(decisions, d)
+		}
+		return decisions, nil
+	}
+	return nil, nil
+}
+
+// findStarted returns the WorkflowExecutionStarted event, if it is in the history.
+func findStarted(events []swf.HistoryEvent) *swf.HistoryEvent {
+	for i := len(events) - 1; i >= 0; i-- {
+		if *events[i].EventType == swf.EventTypeWorkflowExecutionStarted {
+			return &events[i]
+		}
+	}
+	return nil
+}
+
 func (f *FSM) findSerializedErrorState(events []swf.HistoryEvent) (*SerializedErrorState, error) {
 	for _, event := range events {
+		if f.isStateMarker(event) {
+			//an error marker is recorded after its state marker, so the workflow recovered since the last one
+			return nil, nil
+		}
 		if f.isErrorMarker(event) {
 			errState := &SerializedErrorState{}
-			err := f.Serializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, errState)
+			err := f.SystemSerializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, errState)
 			return errState, err
 		}
 	}
@@ -612,7 +1494,7 @@ func (f *FSM) findLastEvents(prevStarted int64, events []swf.HistoryEvent) []swf
 			swf.EventTypeDecisionTaskStarted:
 			//no-op, dont even process these?
 		case swf.EventTypeMarkerRecorded:
-			if !f.isStateMarker(event) && !f.isCorrelatorMarker(event) {
+			if !f.isStateMarker(event) && !f.isStateChunkMarker(event) && !f.isCorrelatorMarker(event) && !f.isVersionMarker(event) && !f.isSideEffectMarker(event) && !f.isErrorMarker(event) {
 				lastEvents = append(lastEvents, event)
 			}
 		default:
@@ -625,42 +1507,113 @@ func (f *FSM) findLastEvents(prevStarted int64, events []swf.HistoryEvent) []swf
 }
 
 func (f *FSM) recordStateMarkers(stateVersion uint64, outcome *Outcome, eventCorrelator *EventCorrelator, errorState *SerializedErrorState) ([]swf.Decision, *SerializedState, error) {
-	serializedData, err := f.Serializer.Serialize(outcome.Data)
-
-	state := &SerializedState{
-		StateVersion: stateVersion + 1, //increment the version here only.
-		StateName:    outcome.State,
-		StateData:    serializedData,
-	}
-	serializedMarker, err := f.systemSerializer.Serialize(state)
-
+	state, serializedMarker, err := f.serializeState(stateVersion, outcome)
 	if err != nil {
 		return nil, state, errors.Trace(err)
 	}
+	decisions, err := f.recordSerializedStateMarkers(state, serializedMarker, outcome, eventCorrelator, errorState)
+	return decisions, state, err
+}
 
-	serializedCorrelator, err := f.systemSerializer.Serialize(eventCorrelator)
+// recordSerializedStateMarkers is recordStateMarkers for a state already serialized by serializeState.
+func (f *FSM) recordSerializedStateMarkers(state *SerializedState, serializedMarker string, outcome *Outcome, eventCorrelator *EventCorrelator, errorState *SerializedErrorState) ([]swf.Decision, error) {
+	serializedCorrelator, err := f.SystemSerializer.Serialize(eventCorrelator)
 
 	if err != nil {
-		return nil, state, errors.Trace(err)
+		return nil, errors.Trace(err)
+	}
+
+	if len(serializedCorrelator) > MaxMarkerDetailsSize {
+		return nil, errors.Errorf("correlator marker too large size=%d max=%d", len(serializedCorrelator), MaxMarkerDetailsSize)
 	}
 
-	d := f.recordStringMarker(StateMarker, serializedMarker)
+	decisions, err := f.recordStateMarker(serializedMarker)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	c := f.recordStringMarker(CorrelatorMarker, serializedCorrelator)
-	decisions := f.EmptyDecisions()
-	decisions = append(decisions, d, c)
+	decisions = append(decisions, c)
 
 	if errorState != nil {
-		serializedError, err := f.systemSerializer.Serialize(*errorState)
+		serializedError, err := f.SystemSerializer.Serialize(*errorState)
 
 		if err != nil {
-			return nil, state, errors.Trace(err)
+			return nil, errors.Trace(err)
+		}
+		if len(serializedError) > MaxMarkerDetailsSize {
+			return nil, errors.Errorf("error marker too large size=%d max=%d", len(serializedError), MaxMarkerDetailsSize)
 		}
 		e := f.recordStringMarker(ErrorMarker, serializedError)
 		decisions = append(decisions, e)
 	}
 
 	decisions = append(decisions, outcome.Decisions...)
-	return decisions, state, nil
+	return decisions, nil
+}
+
+// serializeState returns the SerializedState of outcome, and the details of the marker that records it.
+func (f *FSM) serializeState(stateVersion uint64, outcome *Outcome) (*SerializedState, string, error) {
+	serializedData, err := f.Serializer.Serialize(outcome.Data)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+
+	state := &SerializedState{
+		StateVersion: stateVersion + 1, //increment the version here only.
+		StateName:    outcome.State,
+		StateData:    serializedData,
+		DataVersion:  f.DataVersion,
+	}
+	serializedMarker, err := f.SystemSerializer.Serialize(state)
+	if err != nil {
+		return state, "", errors.Trace(err)
+	}
+	return state, serializedMarker, nil
+}
+
+// reservedDecisions returns the number of decisions recordStateMarkers needs for the markers of outcome, given the
+// serialized state marker, counting the chunk markers of a state too large for a single marker.
+func reservedDecisions(outcome *Outcome, serializedMarker string) int {
+	reserved := 2
+	if outcome.State == ErrorState {
+		reserved++
+	}
+	if len(serializedMarker) > MaxMarkerDetailsSize {
+		reserved += len(splitMarkerDetails(serializedMarker, MaxMarkerDetailsSize))
+	}
+	return reserved
+}
+
+// recordStateMarker records the serialized state in a single FSM.State marker if it fits,
+// otherwise it splits it across numbered chunk markers followed by an FSM.State marker holding the number of chunks.
+func (f *FSM) recordStateMarker(serializedMarker string) ([]swf.Decision, error) {
+	decisions := f.EmptyDecisions()
+	if len(serializedMarker) <= MaxMarkerDetailsSize {
+		return append(decisions, f.recordStringMarker(StateMarker, serializedMarker)), nil
+	}
+
+	chunks := splitMarkerDetails(serializedMarker, MaxMarkerDetailsSize)
+	if len(chunks) > MaxStateChunks {
+		return nil, errors.Errorf("state marker too large size=%d max=%d, consider a CompressingStateSerializer", len(serializedMarker), MaxStateChunks*MaxMarkerDetailsSize)
+	}
+	for i, chunk := range chunks {
+		decisions = append(decisions, f.recordStringMarker(fmt.Sprintf("%s%d", StateChunkMarker, i+1), chunk))
+	}
+	return append(decisions, f.recordStringMarker(StateMarker, fmt.Sprintf("%s%d", stateChunksPrefix, len(chunks)))), nil
+}
+
+// splitMarkerDetails splits details into chunks of at most size bytes, without splitting a utf8 encoded rune.
+func splitMarkerDetails(details string, size int) []string {
+	var chunks []string
+	for len(details) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(details[end]) {
+			end--
+		}
+		chunks = append(chunks, details[:end])
+		details = details[end:]
+	}
+	return append(chunks, details)
 }
 
 func (f *FSM) recordMarker(markerName string, details interface{}) (swf.Decision, error) {
@@ -682,6 +1635,42 @@ func (f *FSM) recordStringMarker(markerName string, details string) swf.Decision
 	}
 }
 
+// deserializeStateData deserializes the StateData of state into data,
+// first running it through the upcasters needed to bring it from the recorded DataVersion to the FSM.DataVersion.
+func (f *FSM) deserializeStateData(state *SerializedState, data interface{}) error {
+	if state.DataVersion > f.DataVersion {
+		return errors.Errorf("state data version %d is newer than fsm data version %d", state.DataVersion, f.DataVersion)
+	}
+	serialized := state.StateData
+	for version := state.DataVersion; version < f.DataVersion; version++ {
+		upcaster, ok := f.upcasters[version]
+		if !ok {
+			return errors.Errorf("no upcaster for state data version %d", version)
+		}
+		upcasted, err := upcaster(f.Serializer, serialized)
+		if err != nil {
+			return errors.Annotatef(err, "upcasting state data from version %d", version)
+		}
+		serialized = upcasted
+	}
+	return f.Serializer.Deserialize(serialized, data)
+}
+
+func (f *FSM) copyData(data interface{}) (interface{}, error) {
+	if f.DataCopier != nil {
+		return f.DataCopier(data)
+	}
+	return SerializingDataCopier(f.Serializer)(data)
+}
+
+func (f *FSM) stateCacheKey(decisionTask *swf.DecisionTask, state *SerializedState) StateCacheKey {
+	return StateCacheKey{
+		WorkflowID:   *decisionTask.WorkflowExecution.WorkflowID,
+		RunID:        *decisionTask.WorkflowExecution.RunID,
+		StateVersion: state.StateVersion,
+	}
+}
+
 func (f *FSM) zeroStateData() interface{} {
 	return reflect.New(reflect.TypeOf(f.DataType)).Interface()
 }
@@ -695,10 +1684,39 @@ func (f *FSM) isStateMarker(e swf.HistoryEvent) bool {
 	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == StateMarker
 }
 
+func (f *FSM) isStateChunkMarker(e swf.HistoryEvent) bool {
+	return *e.EventType == swf.EventTypeMarkerRecorded && strings.HasPrefix(*e.MarkerRecordedEventAttributes.MarkerName, StateChunkMarker)
+}
+
 func (f *FSM) isCorrelatorMarker(e swf.HistoryEvent) bool {
 	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == CorrelatorMarker
 }
 
+func (f *FSM) isVersionMarker(e swf.HistoryEvent) bool {
+	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == VersionMarker
+}
+
+func (f *FSM) isSideEffectMarker(e swf.HistoryEvent) bool {
+	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == SideEffectMarker
+}
+
+func (f *FSM) isStateTimeout(e swf.HistoryEvent) bool {
+	return *e.EventType == swf.EventTypeTimerFired && strings.HasPrefix(*e.TimerFiredEventAttributes.TimerID, StateTimeoutTimer+".")
+}
+
+func (f *FSM) isErrorRetryTimer(e swf.HistoryEvent) bool {
+	return *e.EventType == swf.EventTypeTimerFired && strings.HasPrefix(*e.TimerFiredEventAttributes.TimerID, ErrorRetryTimer+".")
+}
+
+func (f *FSM) isCloseDecisionFailed(e swf.HistoryEvent) bool {
+	switch *e.EventType {
+	case swf.EventTypeCompleteWorkflowExecutionFailed, swf.EventTypeFailWorkflowExecutionFailed,
+		swf.EventTypeCancelWorkflowExecutionFailed, swf.EventTypeContinueAsNewWorkflowExecutionFailed:
+		return true
+	}
+	return false
+}
+
 func (f *FSM) isErrorMarker(e swf.HistoryEvent) bool {
 	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == ErrorMarker
 }
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"code.google.com/p/goprotobuf/proto"
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/swf"
@@ -17,10 +21,19 @@ const (
 	StateMarker       = "FSM.State"
 	CorrelatorMarker  = "FSM.Correlator"
 	ErrorMarker       = "FSM.Error"
+	VersionMarker     = "FSM.Version"
+	SideEffectMarker  = "FSM.SideEffect"
 	RepiarStateSignal = "FSM.RepairState"
 	ContinueTimer     = "FSM.ContinueWorkflow"
 	ContinueSignal    = "FSM.ContinueWorkflow"
+	StateTimeoutTimer = "FSM.StateTimeout"
+	StateTimeoutEvent = "FSM.StateTimeout"
+	ErrorRetryTimer   = "FSM.ErrorRetry"
+	ErrorSignal       = "FSM.Error"
+	AwaitTimer        = "FSM.Await"
+	ScheduleTimer     = "FSM.Schedule"
 	CompleteState     = "complete"
+	CancelState       = "cancel"
 	ErrorState        = "error"
 	//the FSM was not configured with a state named in an outcome.
 	FSMErrorMissingState = "ErrorMissingFsmState"
@@ -32,6 +45,30 @@ const (
 	FSMErrorCorrelationDeserialization = "ErrorCorrelationDeserialization"
 )
 
+// constants for the sizes SWF accepts, and for splitting large state across markers
+const (
+	// MaxMarkerDetailsSize is the largest marker details SWF will record.
+	MaxMarkerDetailsSize = 32768
+	// MaxInputSize is the largest workflow input SWF will accept.
+	MaxInputSize = 32768
+	// StateChunkMarker is the prefix of the numbered markers, FSM.State.1 ... FSM.State.n,
+	// that hold the parts of a state marker which is too large for a single marker.
+	StateChunkMarker = "FSM.State."
+	// MaxStateChunks is the largest number of markers the FSM will split a state marker across.
+	MaxStateChunks = 16
+	// DefaultStashLimit is the most events FSMContext.Stash will hold when FSM.StashLimit is not set.
+	DefaultStashLimit = 20
+	// DefaultCloseDecisionRetries is how many times a failed close decision is retried when FSM.MaxCloseDecisionRetries is not set.
+	DefaultCloseDecisionRetries = 5
+	// DefaultErrorRetryInterval is the first backoff of an ErrorRecoveryPolicy when RetryInterval is not set.
+	DefaultErrorRetryInterval = 30 * time.Second
+	// MaxStackTraceSize is the most of a stack trace recorded in an FSM.Error marker.
+	MaxStackTraceSize = 4096
+)
+
+// stateChunksPrefix starts the details of a state marker that was split across chunk markers, followed by the number of chunks.
+const stateChunksPrefix = "chunks:"
+
 // Decider decides an Outcome based on an event and the current data for an
 // FSM. You can assert the interface{} parameter that is passed to the Decider
 // as the type of the DataType field in the FSM. Alternatively, you can use
@@ -53,6 +90,21 @@ type FSMState struct {
 	Name string
 	// Decider decides an Outcome given the current state, data, and an event.
 	Decider Decider
+	// Parent, if set, is the name of another FSMState this state is nested in. When the Decider returns an Outcome without a State,
+	// like the one from FSMContext.Pass, the event falls back to the Decider of the Parent. The workflow stays in this state,
+	// and the OnExit, OnEnter and Timeout of the Parent only apply when moving into or out of the Parent and all of its children.
+	// Init checks that the Parent is in the FSM and that states are not nested in themselves. Outcomes are not checked against the
+	// hierarchy, a Decider can move the workflow to any state.
+	Parent string
+	// OnEnter, if set, is called with the event and data of an Outcome that moves the workflow into this state from another one,
+	// and for the initial state with the WorkflowExecutionStarted event of a new workflow, before its Decider.
+	// The Decisions and Data of the Outcome it returns are merged into the transition, its State is ignored.
+	OnEnter Decider
+	// OnExit, if set, is called like OnEnter when an Outcome moves the workflow out of this state, before the OnEnter of the next state.
+	OnExit Decider
+	// Timeout, if set, starts a timer when the workflow enters this state, or starts in it, which is cancelled when it leaves.
+	// If the timer fires the Decider gets a synthetic event with the EventType StateTimeoutEvent.
+	Timeout time.Duration
 }
 
 //DecisionErrorHandler is the error handling contract for panics that occur in Deciders.
@@ -76,6 +128,7 @@ type ReplicationData struct {
 	StateVersion uint64 `json:"stateVersion"`
 	StateName    string `json:"stateName"`
 	StateData    string `json:"stateData"`
+	DataVersion  int    `json:"dataVersion,omitempty"`
 }
 
 // StateSerializer defines the interface for serializing state to and deserializing state from the workflow history.
@@ -84,6 +137,10 @@ type StateSerializer interface {
 	Deserialize(serialized string, state interface{}) error
 }
 
+// Upcaster migrates serialized state data from one FSM.DataVersion to the next, before it is deserialized into the DataType.
+// It is given the FSM.Serializer, so it can deserialize the data into a struct for the old version and serialize it as the new one.
+type Upcaster func(serializer StateSerializer, serialized string) (string, error)
+
 // JSONStateSerializer is a StateSerializer that uses go json serialization.
 type JSONStateSerializer struct{}
 
@@ -129,6 +186,7 @@ func (p ProtobufStateSerializer) Deserialize(serialized string, state interface{
 // but serves to break the circular dep between FSMContext and FSM.
 type Serialization interface {
 	EventData(h swf.HistoryEvent, data interface{})
+	TryEventData(h swf.HistoryEvent, data interface{}) error
 	Serialize(data interface{}) string
 	StateSerializer() StateSerializer
 	Deserialize(serialized string, data interface{})
@@ -144,6 +202,22 @@ type FSMContext struct {
 	State           string
 	stateData       interface{}
 	stateVersion    uint64
+	//decisions made by FSMContext helpers while deciding an event, which Decide adds to the Outcome
+	pendingDecisions []swf.Decision
+	//the event being decided, and the number of ids NewID has generated for it
+	event *swf.HistoryEvent
+	ids   int
+	//set by Stash, so Decide leaves the correlation of the stashed event in place until it is replayed
+	stashed bool
+	//the error the workflow is waiting to be repaired from, while it is in the ErrorState
+	errorState *SerializedErrorState
+	//the start of the current run, when it is in the history, whose settings are used by ContinueWorkflowDecision
+	started *swf.HistoryEvent
+	//the history of the decision task, and its size encoded as json once historyBytes has measured it
+	history      []swf.HistoryEvent
+	historyBytes int
+	//timers started by decisions of the decision task, which are not open in the correlator until their TimerStarted event
+	startedTimers map[string]bool
 }
 
 // NewFSMContext constructs an FSMContext.
@@ -163,6 +237,12 @@ func NewFSMContext(
 	}
 }
 
+// fsm returns the FSM that created this context, or nil if it was created with some other Serialization.
+func (f *FSMContext) fsm() *FSM {
+	fsm, _ := f.serialization.(*FSM)
+	return fsm
+}
+
 // ContinueDecider is a helper func to easily create a ContinueOutcome.
 func (f *FSMContext) ContinueDecider(data interface{}, decisions []swf.Decision) Outcome {
 	return Outcome{
@@ -224,16 +304,182 @@ func (f *FSMContext) ContinueWorkflow(data interface{}, decisions ...swf.Decisio
 
 // Decide executes a decider making sure that Activity tasks are being tracked.
 func (f *FSMContext) Decide(h swf.HistoryEvent, data interface{}, decider Decider) Outcome {
+	f.event = &h
+	f.ids = 0
+	f.stashed = false
+	outcome := f.run(h, data, decider)
+	if f.stashed {
+		f.eventCorrelator.Correlate(h)
+	} else {
+		f.eventCorrelator.Track(h)
+	}
+	return outcome
+}
+
+// Version returns the version of the code path a workflow should take at a change point in a Decider.
+// The first time a workflow reaches changeID, maxSupported is recorded, both in an FSM.Version marker and in the EventCorrelator.
+// Every later call for changeID returns the recorded version, so a workflow keeps taking the branch it started on
+// when a new version is deployed. Recorded versions are carried over by ContinueWorkflowDecision.
+// It panics if the recorded version is no longer between minSupported and maxSupported.
+func (f *FSMContext) Version(changeID string, minSupported, maxSupported int) int {
+	if version, ok := f.eventCorrelator.Version(changeID); ok {
+		if version < minSupported || version > maxSupported {
+			panic(errors.Errorf("version %d of change %s is not supported, min=%d max=%d", version, changeID, minSupported, maxSupported))
+		}
+		return version
+	}
+
+	f.eventCorrelator.recordVersion(changeID, maxSupported)
+	f.pendingDecisions = append(f.pendingDecisions, f.systemMarker(VersionMarker, ChangeVersion{ChangeID: changeID, Version: maxSupported}))
+	return maxSupported
+}
+
+// run calls a decider, and adds the decisions made by FSMContext helpers to its Outcome.
+func (f *FSMContext) run(h swf.HistoryEvent, data interface{}, decider Decider) Outcome {
+	f.pendingDecisions = nil
 	outcome := decider(f, h, data)
-	f.eventCorrelator.Track(h)
+	if len(f.pendingDecisions) > 0 {
+		outcome.Decisions = append(f.pendingDecisions, outcome.Decisions...)
+		f.pendingDecisions = nil
+	}
 	return outcome
 }
 
+// Stash is a helper func to easily create a StayOutcome that defers the event being decided until the workflow changes state.
+// The event is kept in the EventCorrelator, and when an Outcome moves the workflow to another state, Tick replays
+// the stashed events, oldest first, through the new state's Decider before it processes any newer events.
+// The new state can handle or Stash the events again. See FSM.StashLimit and FSM.StashExpiry.
+func (f *FSMContext) Stash(data interface{}) Outcome {
+	if f.event != nil {
+		limit := DefaultStashLimit
+		if fsm := f.fsm(); fsm != nil && fsm.StashLimit > 0 {
+			limit = fsm.StashLimit
+		}
+		if dropped := f.eventCorrelator.stash(*f.event, limit); dropped != nil {
+			logf(f, "at=stash-full dropped-id=%d dropped-type=%s", *dropped.EventID, *dropped.EventType)
+		}
+		f.stashed = true
+	}
+	return f.Stay(data, f.EmptyDecisions())
+}
+
+// SideEffect runs fn once and deserializes its result into result, which should be a pointer.
+// The serialized result is recorded in an FSM.SideEffect marker and in the EventCorrelator, keyed by name and the event being decided,
+// so when the event is decided again, for instance by ErrorStateTick, the recorded result is returned and fn is not run.
+// Use it for anything non-deterministic a Decider needs, like config lookups or random numbers.
+func (f *FSMContext) SideEffect(name string, fn func() interface{}, result interface{}) {
+	key := sideEffectKey(name, f.eventID())
+	serialized, ok := f.eventCorrelator.SideEffect(key)
+	if !ok {
+		serialized = f.Serialize(fn())
+		f.eventCorrelator.recordSideEffect(key, serialized)
+		f.pendingDecisions = append(f.pendingDecisions, f.systemMarker(SideEffectMarker, SideEffectResult{Name: name, EventID: f.eventID(), Result: serialized}))
+	}
+	f.Deserialize(serialized, result)
+}
+
+// ErrorInfo returns the error a workflow is waiting to be repaired from while an FSM.ErrorRecovery policy holds it in the ErrorState,
+// or nil in any other state.
+func (f *FSMContext) ErrorInfo() *SerializedErrorState {
+	return f.errorState
+}
+
+// RunAge returns how long the current run has been going at the event being decided, or 0 when its start is not in the history.
+func (f *FSMContext) RunAge() time.Duration {
+	if f.started == nil || f.started.EventTimestamp == nil {
+		return 0
+	}
+	return f.Now().Sub(f.started.EventTimestamp.Time)
+}
+
+// HistoryBytes returns the size of the history of the decision task, as json, which is what SWF sends to deciders.
+// It is measured the first time it is called in a decision task.
+func (f *FSMContext) HistoryBytes() int {
+	if f.historyBytes == 0 && len(f.history) > 0 {
+		for _, h := range f.history {
+			encoded, err := json.Marshal(h)
+			if err == nil {
+				f.historyBytes += len(encoded)
+			}
+		}
+	}
+	return f.historyBytes
+}
+
+// Now returns the timestamp of the event being decided, so Deciders see the same time when an event is decided again.
+// Outside of Decide it returns time.Now().
+func (f *FSMContext) Now() time.Time {
+	if f.event == nil || f.event.EventTimestamp == nil {
+		return time.Now()
+	}
+	return f.event.EventTimestamp.Time
+}
+
+// NewID returns a UUID derived from the workflow ID, the event being decided and the number of ids already generated for that event,
+// so Deciders get the same ids when an event is decided again.
+func (f *FSMContext) NewID() string {
+	f.ids++
+	workflowID := ""
+	if f.WorkflowExecution.WorkflowID != nil {
+		workflowID = *f.WorkflowExecution.WorkflowID
+	}
+	return uuid.NewSHA1(uuid.NameSpace_URL, []byte(fmt.Sprintf("swfsm:%s/%d/%d", workflowID, f.eventID(), f.ids))).String()
+}
+
+func (f *FSMContext) eventID() int64 {
+	if f.event == nil || f.event.EventID == nil {
+		return 0
+	}
+	return *f.event.EventID
+}
+
+// timerStarted records that a decision of the decision task starts the timer with timerID.
+func (f *FSMContext) timerStarted(timerID string) {
+	if f.startedTimers == nil {
+		f.startedTimers = make(map[string]bool)
+	}
+	f.startedTimers[timerID] = true
+}
+
+// timerPending returns true if the timer with timerID is open, or a decision of the decision task starts it.
+func (f *FSMContext) timerPending(timerID string) bool {
+	return f.eventCorrelator.TimerOpen(timerID) || f.startedTimers[timerID]
+}
+
+func sideEffectKey(name string, eventID int64) string {
+	return fmt.Sprintf("%s@%d", name, eventID)
+}
+
+// systemMarker builds a RecordMarker decision for an FSM managed marker, serialized with the FSM.SystemSerializer.
+func (f *FSMContext) systemMarker(name string, details interface{}) swf.Decision {
+	var serializer StateSerializer = JSONStateSerializer{}
+	if fsm := f.fsm(); fsm != nil && fsm.SystemSerializer != nil {
+		serializer = fsm.SystemSerializer
+	}
+	serialized, err := serializer.Serialize(details)
+	if err != nil {
+		panic(err)
+	}
+	return swf.Decision{
+		DecisionType: aws.String(swf.DecisionTypeRecordMarker),
+		RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{
+			MarkerName: aws.String(name),
+			Details:    aws.String(serialized),
+		},
+	}
+}
+
 // EventData will extract a payload from the given HistoryEvent and unmarshall it into the given struct.
 func (f *FSMContext) EventData(h swf.HistoryEvent, data interface{}) {
 	f.serialization.EventData(h, data)
 }
 
+// TryEventData will extract a payload from the given HistoryEvent and unmarshall it into the given struct,
+// returning an error when there is no payload or it can not be unmarshalled.
+func (f *FSMContext) TryEventData(h swf.HistoryEvent, data interface{}) error {
+	return f.serialization.TryEventData(h, data)
+}
+
 // ActivityInfo will find information for ActivityTasks being tracked. It can only be used when handling events related to ActivityTasks.
 // ActivityTasks are automatically tracked after a EventTypeActivityTaskScheduled event.
 // When there is no pending activity related to the event, nil is returned.
@@ -283,21 +529,152 @@ func (f *FSMContext) EmptyDecisions() []swf.Decision {
 // ContinueWorkflowDecision will build a ContinueAsNewWorkflow decision that has the expected SerializedState marshalled to json as its input.
 // This decision should be used when it is appropriate to Continue your workflow.
 // You are unable to ContinueAsNew a workflow that has running activites, so you should assure there are none running before using this.
-// As such there is no need to copy over the ActivityCorrelator.
+// The attempt counts, versions, activity groups and fired Once deciders in the EventCorrelator are carried over, and timers that are still open are started again
+// in the continued run, with the time they had left.
+// The execution settings of the continued run are those of FSM.ContinueAsNew, or of the current run where it does not set them.
+// It panics if the input is larger than SWF accepts.
 func (f *FSMContext) ContinueWorkflowDecision(continuedState string, data interface{}) swf.Decision {
+	state := SerializedState{
+		StateName:    continuedState,
+		StateData:    f.Serialize(data),
+		StateVersion: f.stateVersion,
+	}
+	fsm := f.fsm()
+	if fsm != nil {
+		state.DataVersion = fsm.DataVersion
+	}
+	continued := continuation{SerializedState: state}
+	if f.eventCorrelator != nil {
+		continued.Versions = f.eventCorrelator.Versions
+		continued.ActivityAttempts = f.eventCorrelator.ActivityAttempts
+		continued.SignalAttempts = f.eventCorrelator.SignalAttempts
+		continued.Timers = f.continuedTimers()
+		continued.Groups = f.eventCorrelator.Groups
+		continued.Fired = f.eventCorrelator.Fired
+	}
+	input := f.Serialize(continued)
+	if len(input) > MaxInputSize {
+		panic(errors.Errorf("continue-as-new input too large size=%d max=%d", len(input), MaxInputSize))
+	}
+
+	attributes := &swf.ContinueAsNewWorkflowExecutionDecisionAttributes{}
+	if f.started != nil {
+		started := f.started.WorkflowExecutionStartedEventAttributes
+		attributes.ChildPolicy = started.ChildPolicy
+		attributes.ExecutionStartToCloseTimeout = started.ExecutionStartToCloseTimeout
+		attributes.TagList = started.TagList
+		attributes.TaskList = started.TaskList
+		attributes.TaskStartToCloseTimeout = started.TaskStartToCloseTimeout
+		if started.WorkflowType != nil {
+			attributes.WorkflowTypeVersion = started.WorkflowType.Version
+		}
+	}
+	if fsm != nil && fsm.ContinueAsNew != nil {
+		settings := fsm.ContinueAsNew
+		if settings.ChildPolicy != nil {
+			attributes.ChildPolicy = settings.ChildPolicy
+		}
+		if settings.ExecutionStartToCloseTimeout != nil {
+			attributes.ExecutionStartToCloseTimeout = settings.ExecutionStartToCloseTimeout
+		}
+		if settings.TagList != nil {
+			attributes.TagList = settings.TagList
+		}
+		if settings.TaskList != nil {
+			attributes.TaskList = settings.TaskList
+		}
+		if settings.TaskStartToCloseTimeout != nil {
+			attributes.TaskStartToCloseTimeout = settings.TaskStartToCloseTimeout
+		}
+		if settings.WorkflowTypeVersion != nil {
+			attributes.WorkflowTypeVersion = settings.WorkflowTypeVersion
+		}
+	}
+	attributes.Input = aws.String(input)
+
 	return swf.Decision{
 		DecisionType: aws.String(swf.DecisionTypeContinueAsNewWorkflowExecution),
-		ContinueAsNewWorkflowExecutionDecisionAttributes: &swf.ContinueAsNewWorkflowExecutionDecisionAttributes{
-			Input: aws.String(f.Serialize(SerializedState{
-				StateName:    continuedState,
-				StateData:    f.Serialize(data),
-				StateVersion: f.stateVersion,
-			},
-			)),
+		ContinueAsNewWorkflowExecutionDecisionAttributes: attributes,
+	}
+}
+
+// continuedTimers returns the open timers to start again in a continued run, with the seconds they have left, in TimerID order.
+// The timers the FSM uses to continue workflows and retry errors are left behind, as are timers started before their FireTime was tracked.
+func (f *FSMContext) continuedTimers() []continuedTimer {
+	var timers []continuedTimer
+	now := f.Now().Unix()
+	for _, info := range f.eventCorrelator.Timers {
+		if info.TimerID == ContinueTimer || strings.HasPrefix(info.TimerID, ErrorRetryTimer+".") {
+			continue
+		}
+		if info.FireTime == 0 {
+			logf(f, "at=continue-timer-dropped timer-id=%s reason=unknown-fire-time", info.TimerID)
+			continue
+		}
+		remaining := info.FireTime - now
+		if remaining < 0 {
+			remaining = 0
+		}
+		timers = append(timers, continuedTimer{TimerID: info.TimerID, Control: info.Control, Remaining: remaining})
+	}
+	sort.Sort(continuedTimersByID(timers))
+	return timers
+}
+
+// CancelWorkflow is a helper func to easily create an Outcome that moves to the cancel state and sends a CancelWorkflow decision.
+func (f *FSMContext) CancelWorkflow(data interface{}, decisions ...swf.Decision) Outcome {
+	if len(decisions) == 0 || *decisions[len(decisions)-1].DecisionType != swf.DecisionTypeCancelWorkflowExecution {
+		decisions = append(decisions, f.CancelWorkflowDecision(data))
+	}
+	state := CancelState
+	if fsm := f.fsm(); fsm != nil && fsm.cancelState != nil {
+		state = fsm.cancelState.Name
+	}
+	return Outcome{
+		State:     state,
+		Data:      data,
+		Decisions: decisions,
+	}
+}
+
+// CancelWorkflowDecision will build a CancelWorkflowExecution decision that has the serialized data as its details.
+func (f *FSMContext) CancelWorkflowDecision(data interface{}) swf.Decision {
+	return swf.Decision{
+		DecisionType: aws.String(swf.DecisionTypeCancelWorkflowExecution),
+		CancelWorkflowExecutionDecisionAttributes: &swf.CancelWorkflowExecutionDecisionAttributes{
+			Details: aws.String(f.Serialize(data)),
 		},
 	}
 }
 
+// RetryCloseDecision is a helper func to easily create an Outcome that makes the close decision that failed again with the given data.
+// Complete, cancel and continue-as-new decisions are rebuilt with CompleteWorkflowDecision, CancelWorkflowDecision and ContinueWorkflowDecision,
+// and fail decisions keep their reason and details. It should only be used in an FSM.OnCloseDecisionFailed Decider.
+func (f *FSMContext) RetryCloseDecision(data interface{}) Outcome {
+	closed := f.eventCorrelator.Close
+	if closed == nil {
+		return f.Stay(data, f.EmptyDecisions())
+	}
+	var decision swf.Decision
+	switch closed.DecisionType {
+	case swf.DecisionTypeCompleteWorkflowExecution:
+		decision = f.CompleteWorkflowDecision(data)
+	case swf.DecisionTypeCancelWorkflowExecution:
+		decision = f.CancelWorkflowDecision(data)
+	case swf.DecisionTypeContinueAsNewWorkflowExecution:
+		decision = f.ContinueWorkflowDecision(closed.ContinuedState, data)
+	default:
+		decision = swf.Decision{
+			DecisionType: aws.String(swf.DecisionTypeFailWorkflowExecution),
+			FailWorkflowExecutionDecisionAttributes: &swf.FailWorkflowExecutionDecisionAttributes{
+				Reason:  aws.String(closed.Reason),
+				Details: aws.String(closed.Details),
+			},
+		}
+	}
+	return f.Goto(closed.NextState, data, []swf.Decision{decision})
+}
+
 // CompleteWorkflowDecision will build a CompleteWorkflowExecutionDecision decision that has the expected SerializedState marshalled to json as its result.
 // This decision should be used when it is appropriate to Complete your workflow.
 func (f *FSMContext) CompleteWorkflowDecision(data interface{}) swf.Decision {
@@ -313,10 +690,61 @@ func (f *FSMContext) CompleteWorkflowDecision(data interface{}) swf.Decision {
 // a MarkerRecorded event in the workflow history. We also maintain an epoch, which counts the number of times a workflow has
 // been continued, and the StartedId of the DecisionTask that generated this state.  The epoch + the id provide a total ordering
 // of state over the lifetime of different runs of a workflow.
+// DataVersion is the FSM.DataVersion of the schema the StateData was serialized with.
 type SerializedState struct {
 	StateVersion uint64 `json:"stateVersion"`
 	StateName    string `json:"stateName"`
 	StateData    string `json:"stateData"`
+	DataVersion  int    `json:"dataVersion,omitempty"`
+}
+
+// continuation is the input of a continued workflow run: the SerializedState,
+// and what the FSM carries over from the EventCorrelator of the previous run.
+type continuation struct {
+	SerializedState
+	Versions         map[string]int        `json:"versions,omitempty"`
+	ActivityAttempts map[string]int        `json:"activityAttempts,omitempty"`
+	SignalAttempts   map[string]int        `json:"signalAttempts,omitempty"`
+	Timers           []continuedTimer      `json:"timers,omitempty"`
+	Groups           map[string]*GroupInfo `json:"groups,omitempty"`
+	Fired            map[string]bool       `json:"fired,omitempty"`
+}
+
+// continuedTimer is a timer that was open when a workflow continued, started again by the FSM in the continued run.
+type continuedTimer struct {
+	TimerID   string `json:"timerId"`
+	Control   string `json:"control,omitempty"`
+	Remaining int64  `json:"remaining"`
+}
+
+type continuedTimersByID []continuedTimer
+
+func (t continuedTimersByID) Len() int           { return len(t) }
+func (t continuedTimersByID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t continuedTimersByID) Less(i, j int) bool { return t[i].TimerID < t[j].TimerID }
+
+// SideEffectResult is recorded in an FSM.SideEffect marker the first time a Decider runs a side effect, see FSMContext.SideEffect.
+type SideEffectResult struct {
+	Name    string
+	EventID int64
+	Result  string
+}
+
+// CloseInfo records the close decision made by a decision task in the EventCorrelator, so it can be retried if it fails.
+type CloseInfo struct {
+	DecisionType   string
+	State          string //the state whose Decider made the close decision
+	NextState      string //the state the Outcome moved to
+	ContinuedState string `json:",omitempty"`
+	Reason         string `json:",omitempty"`
+	Details        string `json:",omitempty"`
+	Attempts       int    `json:",omitempty"`
+}
+
+// ChangeVersion is recorded in an FSM.Version marker the first time a workflow reaches a change point, see FSMContext.Version.
+type ChangeVersion struct {
+	ChangeID string
+	Version  int
 }
 
 //ErrorState is used as the input to a marker that signifies that the workflow is in an error state.
@@ -324,4 +752,68 @@ type SerializedErrorState struct {
 	EarliestUnprocessedEventID int64
 	LatestUnprocessedEventID   int64
 	ErrorEvent                 swf.HistoryEvent
+	//the number of times an ErrorRecoveryPolicy has tried to decide the unprocessed events
+	Attempts int `json:",omitempty"`
+	//the state the workflow failed in
+	StateName string `json:",omitempty"`
+	//what went wrong, see DecisionPanic. StackTrace is truncated to MaxStackTraceSize
+	ErrorMessage string `json:",omitempty"`
+	ErrorType    string `json:",omitempty"`
+	StackTrace   string `json:",omitempty"`
+}
+
+// DecisionPanic is the error a panic in a Decider is recovered as. It keeps the stack trace of the panic,
+// which is recorded in the FSM.Error marker when the DecisionErrorHandler does not rescue the error.
+type DecisionPanic struct {
+	Value interface{}
+	Stack string
+}
+
+func (p *DecisionPanic) Error() string {
+	if err, ok := p.Value.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprintf("panic in decider: %v", p.Value)
+}
+
+// Cause returns the value the Decider panicked with, if it is an error, so errors.Cause finds it.
+func (p *DecisionPanic) Cause() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// ErrorRecoveryPolicy configures how an FSM recovers from events its Deciders fail on, see FSM.ErrorRecovery.
+// A timer is started after each failure, and the unprocessed events are decided again when it fires,
+// waiting RetryInterval, doubling up to MaxRetryInterval. After MaxAttempts failures the workflow is moved
+// to the ErrorState, where it waits for a RepairState signal.
+type ErrorRecoveryPolicy struct {
+	// RetryInterval is the wait before the first retry, DefaultErrorRetryInterval if not set.
+	RetryInterval time.Duration
+	// MaxRetryInterval caps the doubling of RetryInterval, if set.
+	MaxRetryInterval time.Duration
+	// MaxAttempts is the number of failures before the workflow is moved to the ErrorState. Retries are unlimited when it is 0.
+	MaxAttempts int
+	// OperatorWorkflowID, if set, is sent an FSM.Error signal, with the SerializedErrorState as input, when a workflow is moved to the ErrorState.
+	OperatorWorkflowID string
+	// OnErrorState, if set, is called with the event that failed when a workflow is moved to the ErrorState.
+	// Its decisions are made, and its data is recorded, but its state is ignored.
+	OnErrorState Decider
+}
+
+// backoff is the wait before the retry that follows the given number of attempts.
+func (p *ErrorRecoveryPolicy) backoff(attempts int) time.Duration {
+	interval := p.RetryInterval
+	if interval <= 0 {
+		interval = DefaultErrorRetryInterval
+	}
+	for i := 1; i < attempts; i++ {
+		interval *= 2
+		if p.MaxRetryInterval > 0 && interval >= p.MaxRetryInterval {
+			return p.MaxRetryInterval
+		}
+	}
+	if p.MaxRetryInterval > 0 && interval > p.MaxRetryInterval {
+		return p.MaxRetryInterval
+	}
+	return interval
 }
@@ -0,0 +1,254 @@
+package fsm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func versionMarkerPredicate(d swf.Decision) bool {
+	return *d.DecisionType == swf.DecisionTypeRecordMarker && *d.RecordMarkerDecisionAttributes.MarkerName == VersionMarker
+}
+
+func TestVersion(t *testing.T) {
+	fsm := testFSM()
+	var versions []int
+	fsm.AddInitialState(&FSMState{
+		Name: "ok",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			versions = append(versions, f.Version("change", 1, 2))
+			return f.Stay(d, nil)
+		},
+	})
+
+	signal := swf.HistoryEvent{
+		EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("signal")},
+	}
+	start := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: S(fsm.Serialize(new(TestData))),
+		},
+	}
+
+	//a new workflow records the max version once, and keeps it
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{signal, start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0] != 2 || versions[1] != 2 {
+		t.Fatal("expected max version", versions)
+	}
+	marker := FindDecision(decisions, versionMarkerPredicate)
+	if marker == nil {
+		t.Fatal("expected a version marker", decisions)
+	}
+	recorded := &ChangeVersion{}
+	fsm.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, recorded)
+	if recorded.ChangeID != "change" || recorded.Version != 2 {
+		t.Fatal(recorded)
+	}
+	count := 0
+	for _, d := range decisions {
+		if versionMarkerPredicate(d) {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatal("expected one version marker", count)
+	}
+
+	//an older workflow keeps its recorded version
+	ctx.eventCorrelator.Versions["change"] = 1
+	versions = nil
+	correlatorMarker := swf.HistoryEvent{
+		EventType: S(swf.EventTypeMarkerRecorded),
+		MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+			MarkerName: S(CorrelatorMarker),
+			Details:    S(fsm.Serialize(ctx.eventCorrelator)),
+		},
+	}
+	stateMarker := swf.HistoryEvent{
+		EventType: S(swf.EventTypeMarkerRecorded),
+		MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+			MarkerName: S(StateMarker),
+			Details:    S(fsm.Serialize(SerializedState{StateVersion: 1, StateName: "ok", StateData: fsm.Serialize(new(TestData))})),
+		},
+	}
+	_, decisions, _, err = fsm.Tick(testDecisionTask(4, []swf.HistoryEvent{signal, correlatorMarker, stateMarker}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0] != 1 || Find(decisions, versionMarkerPredicate) {
+		t.Fatal("expected the recorded version", versions, decisions)
+	}
+
+	//versions are carried over to continued runs
+	ctx.State = "ok"
+	cont := ctx.ContinueWorkflowDecision("ok", new(TestData))
+	continued := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:                   cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+			ContinuedExecutionRunID: S("previous"),
+		},
+	}
+	versions = nil
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{continued}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0] != 1 || Find(decisions, versionMarkerPredicate) {
+		t.Fatal("expected the version to be carried over", versions, decisions)
+	}
+
+	//unsupported versions panic
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected a panic for an unsupported version")
+		}
+	}()
+	ctx.Version("change", 2, 3)
+}
+
+func sideEffectMarkerPredicate(d swf.Decision) bool {
+	return *d.DecisionType == swf.DecisionTypeRecordMarker && *d.RecordMarkerDecisionAttributes.MarkerName == SideEffectMarker
+}
+
+func TestSideEffect(t *testing.T) {
+	fsm := testFSM()
+	calls := 0
+	var results []string
+	fsm.AddInitialState(&FSMState{
+		Name: "ok",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			var result string
+			f.SideEffect("lookup", func() interface{} {
+				calls++
+				return "looked-up"
+			}, &result)
+			results = append(results, result)
+			return f.Stay(d, nil)
+		},
+	})
+
+	start := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: S(fsm.Serialize(new(TestData))),
+		},
+	}
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || len(results) != 1 || results[0] != "looked-up" {
+		t.Fatal("expected the side effect to run", calls, results)
+	}
+	marker := FindDecision(decisions, sideEffectMarkerPredicate)
+	if marker == nil {
+		t.Fatal("expected a side effect marker", decisions)
+	}
+	recorded := &SideEffectResult{}
+	fsm.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, recorded)
+	var recordedResult string
+	fsm.Deserialize(recorded.Result, &recordedResult)
+	if recorded.Name != "lookup" || recordedResult != "looked-up" {
+		t.Fatal(recorded)
+	}
+	if len(ctx.eventCorrelator.SideEffects) != 0 {
+		t.Fatal("expected side effects to be cleared once the events are processed", ctx.eventCorrelator.SideEffects)
+	}
+}
+
+func TestSideEffectIsNotRunAgainByErrorRecovery(t *testing.T) {
+	failing := true
+	calls := 0
+	var results []string
+	fsm := testFSM()
+	fsm.allowPanics = false
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				var result string
+				f.SideEffect("lookup", func() interface{} {
+					calls++
+					return fmt.Sprintf("looked-up-%d", calls)
+				}, &result)
+				results = append(results, result)
+				if failing {
+					panic(fmt.Errorf("boom"))
+				}
+			}
+			return f.Stay(d, nil)
+		},
+	})
+	fsm.ErrorRecovery = &ErrorRecoveryPolicy{RetryInterval: 10 * time.Second}
+	fsm.Init()
+
+	history := errorRecoveryTestEvents(fsm)
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a replay that fails again keeps the recorded result
+	history = append(retryTimerFired(6, 1), append(markerEvents(decisions, 3), history...)...)
+	_, decisions, _, err = fsm.Tick(testDecisionTask(6, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing = false
+	history = append(retryTimerFired(11, 2), append(markerEvents(decisions, 8), history...)...)
+	ctx, _, _, err := fsm.Tick(testDecisionTask(11, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || !reflect.DeepEqual(results, []string{"looked-up-1", "looked-up-1", "looked-up-1"}) {
+		t.Fatal("expected the side effect to run once, and the replays to get its result", calls, results)
+	}
+	if len(ctx.eventCorrelator.SideEffects) != 0 {
+		t.Fatal("expected side effects to be cleared once the events are processed", ctx.eventCorrelator.SideEffects)
+	}
+}
+
+func TestDeterministicNowAndNewID(t *testing.T) {
+	fsm := testFSM()
+	var now []time.Time
+	var ids []string
+	decider := func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+		now = append(now, f.Now())
+		ids = append(ids, f.NewID(), f.NewID())
+		return f.Stay(d, nil)
+	}
+
+	stamp := time.Unix(1234, 0)
+	event := swf.HistoryEvent{EventID: L(7), EventType: S(swf.EventTypeWorkflowExecutionSignaled), EventTimestamp: &aws.UnixTimestamp{Time: stamp}}
+	testContext(fsm).Decide(event, new(TestData), decider)
+	testContext(fsm).Decide(event, new(TestData), decider)
+
+	if !now[0].Equal(stamp) || !now[1].Equal(stamp) {
+		t.Fatal("expected the event timestamp", now)
+	}
+	if ids[0] == ids[1] {
+		t.Fatal("expected distinct ids for one event", ids)
+	}
+	if ids[0] != ids[2] || ids[1] != ids[3] {
+		t.Fatal("expected the same ids when the event is decided again", ids)
+	}
+
+	other := event
+	other.EventID = L(8)
+	testContext(fsm).Decide(other, new(TestData), decider)
+	if ids[4] == ids[0] {
+		t.Fatal("expected different ids for a different event", ids)
+	}
+}
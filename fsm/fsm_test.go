@@ -1,8 +1,11 @@
 package fsm
 
 import (
+	"fmt"
 	"log"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -497,6 +500,69 @@ func TestContinueWorkflowDecision(t *testing.T) {
 
 }
 
+func TestContinueWorkflowCarriesCorrelatorAndSettings(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddInitialState(&FSMState{
+		Name: "InitialState",
+		Decider: func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, nil)
+		},
+	})
+	fsm.ContinueAsNew = &swf.ContinueAsNewWorkflowExecutionDecisionAttributes{TaskList: &swf.TaskList{Name: S("continued")}}
+	fsm.Init()
+
+	ctx := testContext(fsm)
+	ctx.event = &swf.HistoryEvent{EventTimestamp: &aws.UnixTimestamp{time.Unix(1000, 0)}}
+	ctx.started = &swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			ChildPolicy:             S(swf.ChildPolicyAbandon),
+			TaskList:                &swf.TaskList{Name: S("started")},
+			TaskStartToCloseTimeout: S("30"),
+			WorkflowType:            &swf.WorkflowType{Name: S("test-workflow"), Version: S("2")},
+		},
+	}
+	ctx.eventCorrelator.Track(swf.HistoryEvent{
+		EventID:        I(3),
+		EventType:      S(swf.EventTypeTimerStarted),
+		EventTimestamp: &aws.UnixTimestamp{time.Unix(900, 0)},
+		TimerStartedEventAttributes: &swf.TimerStartedEventAttributes{
+			TimerID:            S("reminder"),
+			Control:            S("control"),
+			StartToFireTimeout: S("200"),
+		},
+	})
+	ctx.eventCorrelator.Timers["4"] = &TimerInfo{TimerID: ContinueTimer, FireTime: 1100}
+	ctx.eventCorrelator.ActivityAttempts["activity"] = 2
+
+	cont := ctx.ContinueWorkflowDecision("InitialState", &TestData{})
+	attributes := cont.ContinueAsNewWorkflowExecutionDecisionAttributes
+	if *attributes.TaskList.Name != "continued" || *attributes.ChildPolicy != swf.ChildPolicyAbandon ||
+		*attributes.TaskStartToCloseTimeout != "30" || *attributes.WorkflowTypeVersion != "2" {
+		t.Fatal("expected the settings of the FSM, then those of the current run", attributes)
+	}
+
+	continued := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:                   attributes.Input,
+			ContinuedExecutionRunID: S("previous"),
+		},
+	}
+	next, decisions, _, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{continued}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := FindDecision(decisions, startTimerPredicate)
+	if timer == nil || *timer.StartTimerDecisionAttributes.TimerID != "reminder" || *timer.StartTimerDecisionAttributes.StartToFireTimeout != "100" ||
+		*timer.StartTimerDecisionAttributes.Control != "control" || len(decisions) != 3 {
+		t.Fatal("expected the open timer to be started again with the time it had left", decisions)
+	}
+	if next.eventCorrelator.ActivityAttempts["activity"] != 2 {
+		t.Fatal("expected the attempts to be carried over", next.eventCorrelator)
+	}
+}
+
 func TestCompleteState(t *testing.T) {
 	fsm := testFSM()
 
@@ -528,7 +594,7 @@ func testFSM() *FSM {
 		Name:             "test-fsm",
 		DataType:         TestData{},
 		Serializer:       JSONStateSerializer{},
-		systemSerializer: JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
 		allowPanics:      true,
 	}
 	return fsm
@@ -572,3 +638,1131 @@ func testHistoryEvent(eventID int, eventType string) swf.HistoryEvent {
 
 var testWorkflowExecution = &swf.WorkflowExecution{WorkflowID: S("workflow-id"), RunID: S("run-id")}
 var testWorkflowType = &swf.WorkflowType{Name: S("workflow-name"), Version: S("workflow-version")}
+
+func TestLargeStateIsChunked(t *testing.T) {
+	fsm := testFSM()
+	data := &TestData{}
+	for i := 0; i < 4000; i++ {
+		data.States = append(data.States, "state-"+strconv.Itoa(i))
+	}
+
+	decisions, _, err := fsm.recordStateMarkers(0, &Outcome{State: "working", Data: data}, &EventCorrelator{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := 0
+	for _, d := range decisions {
+		name := *d.RecordMarkerDecisionAttributes.MarkerName
+		if strings.HasPrefix(name, StateChunkMarker) {
+			chunks++
+		}
+		if len(*d.RecordMarkerDecisionAttributes.Details) > MaxMarkerDetailsSize {
+			t.Fatal("marker over the size limit", name)
+		}
+	}
+	if chunks < 2 {
+		t.Fatal("expected the state to be split into chunks", chunks)
+	}
+
+	//history is in reverse order, newest first
+	var events []swf.HistoryEvent
+	for i := len(decisions) - 1; i >= 0; i-- {
+		events = append(events, swf.HistoryEvent{
+			EventType: S(swf.EventTypeMarkerRecorded),
+			EventID:   I(100 + i),
+			MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+				MarkerName: decisions[i].RecordMarkerDecisionAttributes.MarkerName,
+				Details:    decisions[i].RecordMarkerDecisionAttributes.Details,
+			},
+		})
+	}
+
+	state, err := fsm.findSerializedState(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := &TestData{}
+	fsm.Deserialize(state.StateData, read)
+	if state.StateName != "working" || len(read.States) != 4000 {
+		t.Fatal("state not reassembled", state.StateName, len(read.States))
+	}
+
+	if last := fsm.findLastEvents(0, events); len(last) != 0 {
+		t.Fatal("chunk markers should not be passed to deciders", last)
+	}
+
+	if _, err := fsm.findSerializedState(events[:2]); err == nil {
+		t.Fatal("expected an error for missing chunks")
+	}
+
+	for i := 0; i < 60000; i++ {
+		data.States = append(data.States, "state-"+strconv.Itoa(i))
+	}
+	if _, _, err := fsm.recordStateMarkers(0, &Outcome{State: "working", Data: data}, &EventCorrelator{}, nil); err == nil {
+		t.Fatal("expected an error for state too large to chunk")
+	}
+}
+
+func TestUpcastingStateData(t *testing.T) {
+	type v0Data struct {
+		Names []string
+	}
+
+	fsm := testFSM()
+	fsm.DataVersion = 2
+	fsm.AddUpcaster(0, func(ser StateSerializer, serialized string) (string, error) {
+		old := &v0Data{}
+		if err := ser.Deserialize(serialized, old); err != nil {
+			return "", err
+		}
+		return ser.Serialize(&TestData{States: old.Names})
+	})
+	fsm.AddUpcaster(1, func(ser StateSerializer, serialized string) (string, error) {
+		data := &TestData{}
+		if err := ser.Deserialize(serialized, data); err != nil {
+			return "", err
+		}
+		data.States = append(data.States, "v2")
+		return ser.Serialize(data)
+	})
+
+	var seen *TestData
+	fsm.AddInitialState(&FSMState{
+		Name: "ok",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			seen = d.(*TestData)
+			return f.Stay(d, nil)
+		},
+	})
+
+	marker := func(state SerializedState) swf.HistoryEvent {
+		return swf.HistoryEvent{
+			EventType: S(swf.EventTypeMarkerRecorded),
+			MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+				MarkerName: S(StateMarker),
+				Details:    S(fsm.Serialize(state)),
+			},
+		}
+	}
+	signal := swf.HistoryEvent{
+		EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("signal")},
+	}
+
+	v0 := marker(SerializedState{StateVersion: 3, StateName: "ok", StateData: fsm.Serialize(&v0Data{Names: []string{"v0"}})})
+	_, _, state, err := fsm.Tick(testDecisionTask(4, []swf.HistoryEvent{signal, v0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen.States) != 2 || seen.States[0] != "v0" || seen.States[1] != "v2" {
+		t.Fatal("state data not upcast", seen)
+	}
+	if state.DataVersion != 2 {
+		t.Fatal("expected the current data version to be recorded", state.DataVersion)
+	}
+
+	continued := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:                   S(fsm.Serialize(SerializedState{StateName: "ok", StateData: fsm.Serialize(&TestData{States: []string{"v1"}}), DataVersion: 1})),
+			ContinuedExecutionRunID: S("someRunId"),
+		},
+	}
+	if _, _, _, err = fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{continued})); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen.States) != 2 || seen.States[1] != "v2" {
+		t.Fatal("continued state data not upcast", seen)
+	}
+
+	newer := &SerializedState{StateName: "ok", StateData: fsm.Serialize(&TestData{}), DataVersion: 3}
+	if err := fsm.deserializeStateData(newer, &TestData{}); err == nil {
+		t.Fatal("expected an error for data newer than the fsm")
+	}
+	fsm.DataVersion = 3
+	if err := fsm.deserializeStateData(&SerializedState{StateData: "{}"}, &TestData{}); err == nil {
+		t.Fatal("expected an error for a missing upcaster")
+	}
+}
+
+func stashTestFSM() *FSM {
+	fsm := testFSM()
+	signalName := func(h swf.HistoryEvent) string {
+		if *h.EventType != swf.EventTypeWorkflowExecutionSignaled {
+			return ""
+		}
+		return *h.WorkflowExecutionSignaledEventAttributes.SignalName
+	}
+	fsm.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			switch signalName(h) {
+			case "ready":
+				return f.Goto("working", d, nil)
+			case "":
+				return f.Stay(d, nil)
+			}
+			return StashDecider()(f, h, d)
+		},
+	})
+	fsm.AddState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			data := d.(*TestData)
+			data.States = append(data.States, signalName(h))
+			return f.Stay(data, nil)
+		},
+	})
+	return fsm
+}
+
+func stashTestEvents(fsm *FSM, signals ...string) []swf.HistoryEvent {
+	var events []swf.HistoryEvent
+	for i := len(signals) - 1; i >= 0; i-- {
+		events = append(events, swf.HistoryEvent{
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(signals[i])},
+		})
+	}
+	return append(events, swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: S(fsm.Serialize(new(TestData))),
+		},
+	})
+}
+
+func TestStashedEventsReplayOnTransition(t *testing.T) {
+	fsm := stashTestFSM()
+
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, stashTestEvents(fsm, "first", "second")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != "waiting" || len(ctx.eventCorrelator.Stashed) != 2 {
+		t.Fatal("expected the signals to be stashed", ctx.State, ctx.eventCorrelator.Stashed)
+	}
+
+	events := append(DecisionsToEvents(decisions), stashTestEvents(fsm, "first", "second")...)
+	ready := swf.HistoryEvent{
+		EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("ready")},
+	}
+	later := swf.HistoryEvent{
+		EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("later")},
+	}
+	events = append([]swf.HistoryEvent{later, ready}, events...)
+	ctx, _, _, err = fsm.Tick(testDecisionTask(len(events)-2, events))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := ctx.stateData.(*TestData)
+	if ctx.State != "working" || !reflect.DeepEqual(data.States, []string{"first", "second", "later"}) {
+		t.Fatal("expected stashed signals to be replayed before newer events", ctx.State, data.States)
+	}
+	if len(ctx.eventCorrelator.Stashed) != 0 {
+		t.Fatal("expected an empty stash", ctx.eventCorrelator.Stashed)
+	}
+}
+
+func TestStashLimitAndExpiry(t *testing.T) {
+	fsm := stashTestFSM()
+	fsm.StashLimit = 2
+
+	ctx, _, _, err := fsm.Tick(testDecisionTask(0, stashTestEvents(fsm, "first", "second", "third", "ready")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ctx.stateData.(*TestData)
+	if !reflect.DeepEqual(data.States, []string{"second", "third"}) {
+		t.Fatal("expected the oldest stashed signal to be dropped", data.States)
+	}
+
+	fsm = stashTestFSM()
+	fsm.StashExpiry = time.Minute
+	task := testDecisionTask(0, stashTestEvents(fsm, "stale", "fresh", "ready"))
+	for i, stamp := range []int64{120, 90, 0, 0} {
+		task.Events[i].EventTimestamp = &aws.UnixTimestamp{time.Unix(stamp, 0)}
+	}
+	ctx, _, _, err = fsm.Tick(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = ctx.stateData.(*TestData)
+	if !reflect.DeepEqual(data.States, []string{"fresh"}) {
+		t.Fatal("expected the expired signal to be dropped", data.States)
+	}
+}
+
+func hookTestFSM() *FSM {
+	fsm := testFSM()
+	marker := func(name string) swf.Decision {
+		return swf.Decision{
+			DecisionType:                   S(swf.DecisionTypeRecordMarker),
+			RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{MarkerName: S(name)},
+		}
+	}
+	hook := func(name string) Decider {
+		return func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			data := d.(*TestData)
+			data.States = append(data.States, name+"-"+f.State)
+			return f.Stay(data, []swf.Decision{marker(name)})
+		}
+	}
+	signaled := func(h swf.HistoryEvent, name string) bool {
+		return *h.EventType == swf.EventTypeWorkflowExecutionSignaled && *h.WorkflowExecutionSignaledEventAttributes.SignalName == name
+	}
+	fsm.AddInitialState(&FSMState{
+		Name: "a",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			if signaled(h, "go") {
+				return f.Goto("b", d, []swf.Decision{marker("decided")})
+			}
+			return f.Stay(d, nil)
+		},
+		OnExit: hook("exit"),
+	})
+	fsm.AddState(&FSMState{
+		Name: "b",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			switch {
+			case *h.EventType == StateTimeoutEvent:
+				return f.Goto("c", d, []swf.Decision{f.CompleteWorkflowDecision(d)})
+			case signaled(h, "leave"):
+				return f.Goto("c", d, nil)
+			}
+			return f.Stay(d, nil)
+		},
+		OnEnter: hook("enter"),
+		Timeout: 30 * time.Second,
+	})
+	fsm.AddState(&FSMState{
+		Name: "c",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			return f.Stay(d, nil)
+		},
+		OnEnter: hook("enter"),
+	})
+	return fsm
+}
+
+func markerNames(decisions []swf.Decision) []string {
+	var names []string
+	for _, d := range decisions {
+		switch *d.DecisionType {
+		case swf.DecisionTypeRecordMarker:
+			if name := *d.RecordMarkerDecisionAttributes.MarkerName; !strings.HasPrefix(name, "FSM.") {
+				names = append(names, name)
+			}
+		case swf.DecisionTypeStartTimer, swf.DecisionTypeCancelTimer, swf.DecisionTypeCompleteWorkflowExecution:
+			names = append(names, *d.DecisionType)
+		}
+	}
+	return names
+}
+
+func TestStateEntryAndExitHooks(t *testing.T) {
+	fsm := hookTestFSM()
+	start := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: S(fsm.Serialize(new(TestData))),
+		},
+	}
+	signal := func(name string) swf.HistoryEvent {
+		return swf.HistoryEvent{
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)},
+		}
+	}
+
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{signal("go"), start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); !reflect.DeepEqual(names, []string{"exit", "decided", "enter", swf.DecisionTypeStartTimer}) {
+		t.Fatal("unexpected decisions", names)
+	}
+	timer := FindDecision(decisions, startTimerPredicate)
+	if *timer.StartTimerDecisionAttributes.TimerID != StateTimeoutTimer+".b" || *timer.StartTimerDecisionAttributes.StartToFireTimeout != "30" {
+		t.Fatal("unexpected timer", timer.StartTimerDecisionAttributes)
+	}
+	if data := ctx.stateData.(*TestData); ctx.State != "b" || !reflect.DeepEqual(data.States, []string{"exit-a", "enter-b"}) {
+		t.Fatal("expected the hooks to update the data", ctx.State, data.States)
+	}
+
+	//the timer fires, and b gets a state timeout event
+	history := []swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                   I(8),
+			EventType:                 S(swf.EventTypeTimerFired),
+			TimerFiredEventAttributes: &swf.TimerFiredEventAttributes{TimerID: S(StateTimeoutTimer + ".b"), StartedEventID: I(7)},
+		},
+		swf.HistoryEvent{
+			EventID:                     I(7),
+			EventType:                   S(swf.EventTypeTimerStarted),
+			TimerStartedEventAttributes: &swf.TimerStartedEventAttributes{TimerID: S(StateTimeoutTimer + ".b"), Control: S("b")},
+		},
+	}
+	history = append(history, DecisionsToEvents(decisions)...)
+	_, decisions, _, err = fsm.Tick(testDecisionTask(5, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); !reflect.DeepEqual(names, []string{"enter", swf.DecisionTypeCompleteWorkflowExecution}) {
+		t.Fatal("expected no cancel for a fired timer, and the enter decisions before the close decision", names)
+	}
+
+	//leaving b before the timer fires cancels it
+	_, decisions, _, err = fsm.Tick(testDecisionTask(6, append([]swf.HistoryEvent{signal("leave")}, history[1:]...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); !reflect.DeepEqual(names, []string{swf.DecisionTypeCancelTimer, "enter"}) {
+		t.Fatal("expected the timer to be cancelled", names)
+	}
+
+	//entering and leaving b in one decision task starts and cancels the timer
+	_, decisions, _, err = fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{signal("leave"), signal("go"), start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); !reflect.DeepEqual(names, []string{"exit", "decided", "enter", swf.DecisionTypeStartTimer, swf.DecisionTypeCancelTimer, "enter"}) {
+		t.Fatal("expected the timer to be started and cancelled", names)
+	}
+}
+
+func TestInitialStateIsEnteredAtStart(t *testing.T) {
+	fsm := testFSM()
+	hook := func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+		data := d.(*TestData)
+		data.States = append(data.States, "enter-"+f.State)
+		return f.Stay(data, []swf.Decision{swf.Decision{
+			DecisionType:                   S(swf.DecisionTypeRecordMarker),
+			RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{MarkerName: S("enter")},
+		}})
+	}
+	fsm.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				return f.Goto("done", d, nil)
+			}
+			return f.Stay(d, nil)
+		},
+		OnEnter: hook,
+		Timeout: time.Minute,
+	})
+	fsm.AddState(&FSMState{
+		Name: "done",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			return f.Stay(d, nil)
+		},
+	})
+	start := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: S(fsm.Serialize(new(TestData))),
+		},
+	}
+
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); !reflect.DeepEqual(names, []string{"enter", swf.DecisionTypeStartTimer}) {
+		t.Fatal("expected the initial state to be entered", names)
+	}
+	if timer := FindDecision(decisions, startTimerPredicate); *timer.StartTimerDecisionAttributes.TimerID != StateTimeoutTimer+".waiting" {
+		t.Fatal("unexpected timer", timer.StartTimerDecisionAttributes)
+	}
+	if data := ctx.stateData.(*TestData); !reflect.DeepEqual(data.States, []string{"enter-waiting"}) {
+		t.Fatal("expected the hook to update the data", data.States)
+	}
+
+	//leaving the initial state in the first decision task cancels its timer
+	signal := swf.HistoryEvent{
+		EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+		WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")},
+	}
+	_, decisions, _, err = fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{signal, start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); !reflect.DeepEqual(names, []string{"enter", swf.DecisionTypeStartTimer, swf.DecisionTypeCancelTimer}) {
+		t.Fatal("expected the timer to be started and cancelled", names)
+	}
+
+	//a continued run is already in its state
+	cont := ctx.ContinueWorkflowDecision("waiting", ctx.stateData)
+	continued := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:                   cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+			ContinuedExecutionRunID: S("previous"),
+		},
+	}
+	_, decisions, _, err = fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{continued}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := markerNames(decisions); len(names) != 0 {
+		t.Fatal("expected a continued run not to enter its state again", names)
+	}
+}
+
+func TestNestedStatesFallBackToParent(t *testing.T) {
+	fsm := testFSM()
+	var hooks []string
+	hook := func(name string) Decider {
+		return func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			hooks = append(hooks, name)
+			return f.Stay(d, nil)
+		}
+	}
+	signaled := func(h swf.HistoryEvent, name string) bool {
+		return *h.EventType == swf.EventTypeWorkflowExecutionSignaled && *h.WorkflowExecutionSignaledEventAttributes.SignalName == name
+	}
+	fsm.AddState(&FSMState{
+		Name: "active",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			data := d.(*TestData)
+			switch {
+			case signaled(h, "status"):
+				data.States = append(data.States, "status-"+f.State)
+				return f.Stay(data, nil)
+			case signaled(h, "cancel"):
+				return f.Goto("cancelled", data, nil)
+			}
+			return f.Stay(data, nil)
+		},
+		OnExit: hook("exit-active"),
+	})
+	fsm.AddInitialState(&FSMState{
+		Name:   "one",
+		Parent: "active",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			if signaled(h, "next") {
+				return f.Goto("two", d, nil)
+			}
+			return f.Pass()
+		},
+		OnExit: hook("exit-one"),
+	})
+	fsm.AddState(&FSMState{
+		Name:   "two",
+		Parent: "active",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			return f.Pass()
+		},
+		OnEnter: hook("enter-two"),
+		OnExit:  hook("exit-two"),
+	})
+	fsm.AddState(&FSMState{
+		Name: "cancelled",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			return f.Stay(d, nil)
+		},
+		OnEnter: hook("enter-cancelled"),
+	})
+	fsm.Init()
+
+	if !reflect.DeepEqual(fsm.Ancestors("two"), []string{"active"}) || len(fsm.Ancestors("active")) != 0 {
+		t.Fatal("unexpected ancestors", fsm.Ancestors("two"), fsm.Ancestors("active"))
+	}
+
+	signal := func(name string) swf.HistoryEvent {
+		return swf.HistoryEvent{
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)},
+		}
+	}
+	start := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: S(fsm.Serialize(new(TestData))),
+		},
+	}
+	ctx, decisions, state, err := fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{signal("status"), signal("next"), signal("status"), start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ctx.stateData.(*TestData)
+	if state.StateName != "two" || !reflect.DeepEqual(data.States, []string{"status-one", "status-two"}) {
+		t.Fatal("expected the parent to handle the signals and the leaf state to be recorded", state.StateName, data.States)
+	}
+	if !reflect.DeepEqual(hooks, []string{"exit-one", "enter-two"}) {
+		t.Fatal("expected moving between children to leave the parent alone", hooks)
+	}
+
+	hooks = nil
+	events := append([]swf.HistoryEvent{signal("cancel")}, DecisionsToEvents(decisions)...)
+	ctx, _, _, err = fsm.Tick(testDecisionTask(5, events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != "cancelled" || !reflect.DeepEqual(hooks, []string{"exit-two", "exit-active", "enter-cancelled"}) {
+		t.Fatal("expected to exit the child and then the parent", ctx.State, hooks)
+	}
+}
+
+func TestNestedStatesAreValidated(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddInitialState(&FSMState{Name: "child", Parent: "missing"})
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected a panic for a missing parent")
+		}
+	}()
+	fsm.Init()
+}
+
+func markerEvents(decisions []swf.Decision, id int) []swf.HistoryEvent {
+	var events []swf.HistoryEvent
+	for _, d := range decisions {
+		if *d.DecisionType == swf.DecisionTypeRecordMarker {
+			events = append([]swf.HistoryEvent{swf.HistoryEvent{
+				EventID:   I(id),
+				EventType: S(swf.EventTypeMarkerRecorded),
+				MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+					MarkerName: d.RecordMarkerDecisionAttributes.MarkerName,
+					Details:    d.RecordMarkerDecisionAttributes.Details,
+				},
+			}}, events...)
+			id++
+		}
+	}
+	return events
+}
+
+func TestManagedCancellation(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			return f.Stay(d, nil)
+		},
+	})
+	fsm.OnCancelRequested = func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+		data := d.(*TestData)
+		data.States = append(data.States, "cancel-requested")
+		return f.Stay(data, nil)
+	}
+	fsm.Init()
+
+	history := []swf.HistoryEvent{
+		swf.HistoryEvent{EventID: I(4), EventType: S(swf.EventTypeWorkflowExecutionCancelRequested)},
+		swf.HistoryEvent{
+			EventID:                     I(3),
+			EventType:                   S(swf.EventTypeTimerStarted),
+			TimerStartedEventAttributes: &swf.TimerStartedEventAttributes{TimerID: S("timer")},
+		},
+		swf.HistoryEvent{
+			EventID:   I(2),
+			EventType: S(swf.EventTypeActivityTaskScheduled),
+			ActivityTaskScheduledEventAttributes: &swf.ActivityTaskScheduledEventAttributes{
+				ActivityID:   S("activity"),
+				ActivityType: &swf.ActivityType{Name: S("activity"), Version: S("1")},
+			},
+		},
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	}
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != CancelState || !reflect.DeepEqual(ctx.stateData.(*TestData).States, []string{"cancel-requested"}) {
+		t.Fatal("expected to move to the cancel state", ctx.State, ctx.stateData)
+	}
+	cancelActivity := FindDecision(decisions, func(d swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeRequestCancelActivityTask
+	})
+	cancelTimer := FindDecision(decisions, func(d swf.Decision) bool { return *d.DecisionType == swf.DecisionTypeCancelTimer })
+	if cancelActivity == nil || *cancelActivity.RequestCancelActivityTaskDecisionAttributes.ActivityID != "activity" ||
+		cancelTimer == nil || *cancelTimer.CancelTimerDecisionAttributes.TimerID != "timer" {
+		t.Fatal("expected the activity and timer to be cancelled", decisions)
+	}
+	if Find(decisions, cancelWorkflowPredicate) {
+		t.Fatal("expected to wait for the activity to settle", decisions)
+	}
+
+	//the activity is cancelled, so the workflow is
+	history = append(markerEvents(decisions, 5), history...)
+	history = append([]swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                             I(11),
+			EventType:                           S(swf.EventTypeActivityTaskCanceled),
+			ActivityTaskCanceledEventAttributes: &swf.ActivityTaskCanceledEventAttributes{ScheduledEventID: I(2)},
+		},
+		swf.HistoryEvent{
+			EventID:                      I(10),
+			EventType:                    S(swf.EventTypeTimerCanceled),
+			TimerCanceledEventAttributes: &swf.TimerCanceledEventAttributes{StartedEventID: I(3)},
+		},
+		swf.HistoryEvent{EventID: I(9), EventType: S(swf.EventTypeDecisionTaskStarted)},
+	}, history...)
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(9, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel := FindDecision(decisions, cancelWorkflowPredicate)
+	if ctx.State != CancelState || cancel == nil {
+		t.Fatal("expected the workflow to be cancelled", ctx.State, decisions)
+	}
+	data := new(TestData)
+	fsm.Deserialize(*cancel.CancelWorkflowExecutionDecisionAttributes.Details, data)
+	if !reflect.DeepEqual(data.States, []string{"cancel-requested"}) {
+		t.Fatal("expected the final data in the details", data)
+	}
+
+	//with nothing outstanding the workflow is cancelled right away
+	_, decisions, _, err = fsm.Tick(testDecisionTask(0, []swf.HistoryEvent{
+		swf.HistoryEvent{EventType: S(swf.EventTypeWorkflowExecutionCancelRequested)},
+		history[len(history)-1],
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Find(decisions, cancelWorkflowPredicate) {
+		t.Fatal("expected the workflow to be cancelled", decisions)
+	}
+}
+
+func cancelWorkflowPredicate(d swf.Decision) bool {
+	return *d.DecisionType == swf.DecisionTypeCancelWorkflowExecution
+}
+
+func TestFailedCloseDecisionIsRetried(t *testing.T) {
+	fsm := testFSM()
+	signaled := func(h swf.HistoryEvent, name string) bool {
+		return *h.EventType == swf.EventTypeWorkflowExecutionSignaled && *h.WorkflowExecutionSignaledEventAttributes.SignalName == name
+	}
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			data := d.(*TestData)
+			switch {
+			case signaled(h, "finish"):
+				return f.CompleteWorkflow(data)
+			case signaled(h, "more"):
+				data.States = append(data.States, "more")
+			}
+			return f.Stay(data, nil)
+		},
+	})
+	fsm.Init()
+
+	signal := func(id int, name string) swf.HistoryEvent {
+		return swf.HistoryEvent{
+			EventID:                                  I(id),
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)},
+		}
+	}
+	history := []swf.HistoryEvent{
+		signal(2, "finish"),
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	}
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ctx.eventCorrelator.Close
+	if closed == nil || closed.State != "working" || closed.NextState != CompleteState || closed.DecisionType != swf.DecisionTypeCompleteWorkflowExecution {
+		t.Fatal("expected the close decision to be recorded", closed)
+	}
+
+	history = append(markerEvents(decisions, 3), history...)
+	history = append([]swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:   I(9),
+			EventType: S(swf.EventTypeCompleteWorkflowExecutionFailed),
+			CompleteWorkflowExecutionFailedEventAttributes: &swf.CompleteWorkflowExecutionFailedEventAttributes{
+				Cause: S("UNHANDLED_DECISION"),
+			},
+		},
+		signal(8, "more"),
+		swf.HistoryEvent{EventID: I(7), EventType: S(swf.EventTypeDecisionTaskStarted)},
+	}, history...)
+
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(7, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := FindDecision(decisions, completeWorkflowPredicate)
+	if ctx.State != CompleteState || complete == nil {
+		t.Fatal("expected the completion to be retried", ctx.State, decisions)
+	}
+	data := new(TestData)
+	fsm.Deserialize(*complete.CompleteWorkflowExecutionDecisionAttributes.Result, data)
+	if !reflect.DeepEqual(data.States, []string{"more"}) {
+		t.Fatal("expected the new event to be decided by the state that completed", data.States)
+	}
+	if ctx.eventCorrelator.Close == nil || ctx.eventCorrelator.Close.Attempts != 1 {
+		t.Fatal("expected the retry to be counted", ctx.eventCorrelator.Close)
+	}
+
+	//a user hook can override the retry
+	fsm.OnCloseDecisionFailed = func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+		return f.Goto("working", d, nil)
+	}
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(7, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != "working" || Find(decisions, completeWorkflowPredicate) || ctx.eventCorrelator.Close != nil {
+		t.Fatal("expected the hook to keep the workflow open", ctx.State, decisions)
+	}
+
+	//without retries the events go to the complete state
+	fsm.MaxCloseDecisionRetries = -1
+	ctx, _, _, err = fsm.Tick(testDecisionTask(7, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != CompleteState || len(ctx.stateData.(*TestData).States) != 0 {
+		t.Fatal("expected the events to go to the complete state", ctx.State, ctx.stateData)
+	}
+}
+
+func errorRecoveryTestFSM(failing *bool) *FSM {
+	fsm := testFSM()
+	fsm.allowPanics = false
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			data := d.(*TestData)
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				if *failing {
+					panic(fmt.Errorf("boom"))
+				}
+				data.States = append(data.States, *h.WorkflowExecutionSignaledEventAttributes.SignalName)
+			}
+			return f.Stay(data, nil)
+		},
+	})
+	return fsm
+}
+
+func errorRecoveryTestEvents(fsm *FSM) []swf.HistoryEvent {
+	return []swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                                  I(2),
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("work")},
+		},
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	}
+}
+
+func retryTimerFired(id int, attempt int) []swf.HistoryEvent {
+	return []swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                   I(id + 1),
+			EventType:                 S(swf.EventTypeTimerFired),
+			TimerFiredEventAttributes: &swf.TimerFiredEventAttributes{TimerID: S(ErrorRetryTimer + "." + strconv.Itoa(attempt)), StartedEventID: I(id - 1)},
+		},
+		swf.HistoryEvent{EventID: I(id), EventType: S(swf.EventTypeDecisionTaskStarted)},
+	}
+}
+
+func systemMarkerNames(decisions []swf.Decision) []string {
+	var names []string
+	for _, d := range decisions {
+		if *d.DecisionType == swf.DecisionTypeRecordMarker {
+			names = append(names, *d.RecordMarkerDecisionAttributes.MarkerName)
+		}
+	}
+	return names
+}
+
+func retryTimerPredicate(d swf.Decision) bool {
+	return *d.DecisionType == swf.DecisionTypeStartTimer && strings.HasPrefix(*d.StartTimerDecisionAttributes.TimerID, ErrorRetryTimer)
+}
+
+func TestErrorRecoveryRetriesWithBackoff(t *testing.T) {
+	failing := true
+	fsm := errorRecoveryTestFSM(&failing)
+	fsm.ErrorRecovery = &ErrorRecoveryPolicy{RetryInterval: 10 * time.Second, MaxRetryInterval: 15 * time.Second}
+	fsm.Init()
+
+	history := errorRecoveryTestEvents(fsm)
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, history))
+	if err != nil {
+		t.Fatal("expected the error to be handled by the policy", err)
+	}
+	timer := FindDecision(decisions, retryTimerPredicate)
+	if timer == nil || *timer.StartTimerDecisionAttributes.StartToFireTimeout != "10" || !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker, ErrorMarker}) {
+		t.Fatal("expected an error marker and a retry timer", decisions)
+	}
+
+	//a failed retry backs off, and keeps the events that failed
+	history = append(retryTimerFired(6, 1), append(markerEvents(decisions, 3), history...)...)
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(6, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer = FindDecision(decisions, retryTimerPredicate)
+	if timer == nil || *timer.StartTimerDecisionAttributes.StartToFireTimeout != "15" || *timer.StartTimerDecisionAttributes.TimerID != ErrorRetryTimer+".2" {
+		t.Fatal("expected a capped backoff", decisions)
+	}
+	errorState := new(SerializedErrorState)
+	fsm.SystemSerializer.Deserialize(*decisions[2].RecordMarkerDecisionAttributes.Details, errorState)
+	if errorState.Attempts != 2 || *errorState.ErrorEvent.EventID != 2 || ctx.State != "working" {
+		t.Fatal("expected the error state to be carried forward", errorState, ctx.State)
+	}
+
+	//once the decider is fixed the events are decided again
+	failing = false
+	history = append(retryTimerFired(11, 2), append(markerEvents(decisions, 8), history...)...)
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(11, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Find(decisions, retryTimerPredicate) || !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker}) {
+		t.Fatal("expected the workflow to recover", decisions)
+	}
+	if ctx.State != "working" || !reflect.DeepEqual(ctx.stateData.(*TestData).States, []string{"work"}) {
+		t.Fatal("expected the failed signal to be decided", ctx.State, ctx.stateData)
+	}
+}
+
+func TestErrorRecoveryMovesToErrorState(t *testing.T) {
+	failing := true
+	fsm := errorRecoveryTestFSM(&failing)
+	hooked := false
+	fsm.ErrorRecovery = &ErrorRecoveryPolicy{
+		MaxAttempts:        2,
+		OperatorWorkflowID: "operator",
+		OnErrorState: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			hooked = *h.EventID == 2 && f.ErrorInfo().StateName == "working"
+			return f.Stay(d, nil)
+		},
+	}
+	fsm.Init()
+
+	history := errorRecoveryTestEvents(fsm)
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history = append(retryTimerFired(6, 1), append(markerEvents(decisions, 3), history...)...)
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(6, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != ErrorState || Find(decisions, retryTimerPredicate) || !hooked {
+		t.Fatal("expected the workflow to be moved to the error state", ctx.State, decisions)
+	}
+	signal := FindDecision(decisions, func(d swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeSignalExternalWorkflowExecution
+	})
+	if signal == nil || *signal.SignalExternalWorkflowExecutionDecisionAttributes.WorkflowID != "operator" ||
+		*signal.SignalExternalWorkflowExecutionDecisionAttributes.SignalName != ErrorSignal {
+		t.Fatal("expected the operator to be signaled", decisions)
+	}
+
+	//events wait in the error state, which keeps the error marker
+	history = append([]swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                                  I(14),
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("ignored")},
+		},
+		swf.HistoryEvent{EventID: I(13), EventType: S(swf.EventTypeDecisionTaskStarted)},
+	}, append(markerEvents(decisions, 9), history...)...)
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(13, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != ErrorState || !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker, ErrorMarker}) {
+		t.Fatal("expected the workflow to wait in the error state", ctx.State, decisions)
+	}
+
+	//a repair signal replaces the data, and moves the workflow back to the state that failed
+	repaired := &TestData{States: []string{"repaired"}}
+	history = append([]swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:   I(19),
+			EventType: S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{
+				SignalName: S(RepiarStateSignal),
+				Input:      S(fsm.Serialize(repaired)),
+			},
+		},
+		swf.HistoryEvent{EventID: I(18), EventType: S(swf.EventTypeDecisionTaskStarted)},
+	}, append(markerEvents(decisions, 15), history...)...)
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(18, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State != "working" || !reflect.DeepEqual(ctx.stateData, repaired) || !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker}) {
+		t.Fatal("expected the workflow to be repaired", ctx.State, ctx.stateData, decisions)
+	}
+}
+
+func TestErrorRecoveryReplaysTheFailedBatch(t *testing.T) {
+	failing := true
+	fsm := testFSM()
+	fsm.allowPanics = false
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			data := d.(*TestData)
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				name := *h.WorkflowExecutionSignaledEventAttributes.SignalName
+				if name == "bad" && failing {
+					panic(fmt.Errorf("boom"))
+				}
+				data.States = append(data.States, name)
+				return f.Stay(data, []swf.Decision{swf.Decision{
+					DecisionType: S(swf.DecisionTypeStartTimer),
+					StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+						TimerID:            S(name),
+						StartToFireTimeout: S("10"),
+					},
+				}})
+			}
+			return f.Stay(data, nil)
+		},
+	})
+	fsm.ErrorRecovery = &ErrorRecoveryPolicy{RetryInterval: 10 * time.Second}
+	fsm.Init()
+
+	timerStarted := func(id string) func(swf.Decision) bool {
+		return func(d swf.Decision) bool {
+			return *d.DecisionType == swf.DecisionTypeStartTimer && *d.StartTimerDecisionAttributes.TimerID == id
+		}
+	}
+
+	//the signal before the failing one is decided in the same batch
+	history := []swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                                  I(3),
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("bad")},
+		},
+		swf.HistoryEvent{
+			EventID:                                  I(2),
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("first")},
+		},
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	}
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Find(decisions, timerStarted("first")) || !Find(decisions, retryTimerPredicate) {
+		t.Fatal("expected the batch to be left for the retry", decisions)
+	}
+	errorState := new(SerializedErrorState)
+	fsm.SystemSerializer.Deserialize(*decisions[2].RecordMarkerDecisionAttributes.Details, errorState)
+	if errorState.EarliestUnprocessedEventID != 1 || *errorState.ErrorEvent.EventID != 3 {
+		t.Fatal("expected the whole batch to be unprocessed", errorState)
+	}
+	state := new(SerializedState)
+	fsm.SystemSerializer.Deserialize(*decisions[0].RecordMarkerDecisionAttributes.Details, state)
+	if strings.Contains(state.StateData, "first") {
+		t.Fatal("expected the state from before the batch to be recorded", state)
+	}
+
+	//a failed retry widens the window, and keeps the state from before the batch
+	history = append(retryTimerFired(7, 1), append(markerEvents(decisions, 4), history...)...)
+	_, decisions, _, err = fsm.Tick(testDecisionTask(7, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Find(decisions, timerStarted("first")) || !Find(decisions, retryTimerPredicate) {
+		t.Fatal("expected the batch to be left for the next retry", decisions)
+	}
+
+	//the recovery decides every event of the batch again
+	failing = false
+	history = append(retryTimerFired(12, 2), append(markerEvents(decisions, 9), history...)...)
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(12, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ctx.stateData.(*TestData).States, []string{"first", "bad"}) {
+		t.Fatal("expected the data of the whole batch", ctx.stateData)
+	}
+	if !Find(decisions, timerStarted("first")) || !Find(decisions, timerStarted("bad")) || Find(decisions, retryTimerPredicate) {
+		t.Fatal("expected the decisions of the whole batch", decisions)
+	}
+}
+
+func TestErrorMarkerDescribesPanic(t *testing.T) {
+	failing := true
+	fsm := errorRecoveryTestFSM(&failing)
+	fsm.Init()
+
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, errorRecoveryTestEvents(fsm)))
+	if err == nil || err.Error() != "boom" {
+		t.Fatal("expected the panic to be returned", err)
+	}
+	errorState := new(SerializedErrorState)
+	fsm.SystemSerializer.Deserialize(*decisions[2].RecordMarkerDecisionAttributes.Details, errorState)
+	if errorState.ErrorMessage != "boom" || errorState.ErrorType != "*errors.errorString" || errorState.StateName != "working" || errorState.Attempts != 1 {
+		t.Fatal("expected the error to be described", errorState)
+	}
+	if !strings.Contains(errorState.StackTrace, "errorRecoveryTestFSM") || len(errorState.StackTrace) > MaxStackTraceSize {
+		t.Fatal("expected the stack trace of the panic", errorState.StackTrace)
+	}
+}
+
+func TestFailedRecoveryWithoutPolicyCompletesTheTask(t *testing.T) {
+	failing := true
+	fsm := errorRecoveryTestFSM(&failing)
+	fsm.Init()
+
+	history := errorRecoveryTestEvents(fsm)
+	_, decisions, _, _ := fsm.Tick(testDecisionTask(0, history))
+	history = append([]swf.HistoryEvent{
+		swf.HistoryEvent{
+			EventID:                                  I(7),
+			EventType:                                S(swf.EventTypeWorkflowExecutionSignaled),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("more")},
+		},
+		swf.HistoryEvent{EventID: I(6), EventType: S(swf.EventTypeDecisionTaskStarted)},
+	}, append(markerEvents(decisions, 3), history...)...)
+	_, decisions, _, err := fsm.Tick(testDecisionTask(6, history))
+	if err != nil {
+		t.Fatal("expected the error marker to be recorded again without failing the task", err)
+	}
+	if !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker, ErrorMarker}) {
+		t.Fatal("expected the error marker to be recorded again", decisions)
+	}
+	errorState := new(SerializedErrorState)
+	fsm.SystemSerializer.Deserialize(*decisions[2].RecordMarkerDecisionAttributes.Details, errorState)
+	if errorState.EarliestUnprocessedEventID != 1 || errorState.LatestUnprocessedEventID != 13 {
+		t.Fatal("expected the unprocessed window to be widened", errorState)
+	}
+}
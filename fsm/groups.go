@@ -0,0 +1,200 @@
+package fsm
+
+import (
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+)
+
+// The statuses of the members of an activity group, see FSMContext.ScheduleGroup.
+const (
+	GroupMemberScheduled = "scheduled"
+	GroupMemberCompleted = "completed"
+	GroupMemberFailed    = "failed"
+	GroupMemberTimedOut  = "timedOut"
+	GroupMemberCanceled  = "canceled"
+)
+
+// GroupInfo holds the members of an activity group by ActivityID, see FSMContext.ScheduleGroup.
+type GroupInfo struct {
+	Members map[string]*GroupMember
+	// Decided is set when OnGroupCompleted fires for the group.
+	Decided bool `json:",omitempty"`
+}
+
+// GroupMember holds the status of an activity in a group, and its result once it completes, or why it did not.
+type GroupMember struct {
+	Status  string
+	Result  string `json:",omitempty"`
+	Reason  string `json:",omitempty"`
+	Details string `json:",omitempty"`
+}
+
+// Count returns the number of members of the group with a status.
+func (g *GroupInfo) Count(status string) int {
+	count := 0
+	for _, m := range g.Members {
+		if m.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Closed returns the number of members of the group that are no longer running.
+func (g *GroupInfo) Closed() int {
+	return len(g.Members) - g.Count(GroupMemberScheduled)
+}
+
+// GroupPolicy decides when an activity group is completed, see OnGroupCompleted.
+type GroupPolicy func(group *GroupInfo) bool
+
+// GroupAll completes a group when all of its members have closed.
+func GroupAll() GroupPolicy {
+	return func(g *GroupInfo) bool {
+		return g.Closed() == len(g.Members)
+	}
+}
+
+// GroupAny completes a group when one of its members completes, or all of them have closed without completing.
+func GroupAny() GroupPolicy {
+	return GroupQuorum(1)
+}
+
+// GroupQuorum completes a group when n of its members complete, or so many have closed without completing that n no longer can.
+func GroupQuorum(n int) GroupPolicy {
+	return func(g *GroupInfo) bool {
+		completed := g.Count(GroupMemberCompleted)
+		return completed >= n || completed+g.Count(GroupMemberScheduled) < n
+	}
+}
+
+// GroupFailFast completes a group when all of its members complete, or as soon as one of them closes without completing.
+func GroupFailFast() GroupPolicy {
+	return func(g *GroupInfo) bool {
+		completed := g.Count(GroupMemberCompleted)
+		return completed == len(g.Members) || g.Closed() > completed
+	}
+}
+
+// ScheduleGroup tracks ScheduleActivityTask decisions as a group in the EventCorrelator, and returns them.
+// The status and result of each member is recorded as it closes, see FSMContext.Group and OnGroupCompleted.
+// A group that is scheduled again with the same groupID replaces the earlier one.
+func (f *FSMContext) ScheduleGroup(groupID string, activities ...swf.Decision) []swf.Decision {
+	group := &GroupInfo{Members: make(map[string]*GroupMember)}
+	for _, d := range activities {
+		if *d.DecisionType != swf.DecisionTypeScheduleActivityTask {
+			panic("ScheduleGroup only accepts ScheduleActivityTask decisions, got " + *d.DecisionType)
+		}
+		group.Members[*d.ScheduleActivityTaskDecisionAttributes.ActivityID] = &GroupMember{Status: GroupMemberScheduled}
+	}
+	if f.eventCorrelator.Groups == nil {
+		f.eventCorrelator.Groups = make(map[string]*GroupInfo)
+	}
+	f.eventCorrelator.Groups[groupID] = group
+	return activities
+}
+
+// Group returns the activity group with the groupID, or nil if there is none.
+// While a member's closing event is being decided, the group includes the result of that event.
+func (f *FSMContext) Group(groupID string) *GroupInfo {
+	group := f.eventCorrelator.Groups[groupID]
+	if group == nil || f.event == nil {
+		return group
+	}
+	activityID, result := f.eventCorrelator.groupResult(*f.event)
+	if _, ok := group.Members[activityID]; !ok {
+		return group
+	}
+	//the correlator records the result once the event is decided, so deciders get a copy with it
+	members := make(map[string]*GroupMember, len(group.Members))
+	for id, member := range group.Members {
+		members[id] = member
+	}
+	members[activityID] = result
+	return &GroupInfo{Members: members, Decided: group.Decided}
+}
+
+// OnGroupCompleted builds a composed decider that fires once, on the event that completes the activity group with the groupID
+// according to the policy. FSMContext.Group gives the deciders the result of every member that has closed, including this event.
+func OnGroupCompleted(groupID string, policy GroupPolicy, deciders ...Decider) Decider {
+	composed := NewComposedDecider(deciders...)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		tracked := ctx.eventCorrelator.Groups[groupID]
+		if tracked == nil || tracked.Decided {
+			return ctx.Pass()
+		}
+		activityID, _ := ctx.eventCorrelator.groupResult(h)
+		if _, ok := tracked.Members[activityID]; !ok {
+			return ctx.Pass()
+		}
+		group := ctx.Group(groupID)
+		if !policy(group) {
+			return ctx.Pass()
+		}
+		logf(ctx, "at=group-completed group=%s completed=%d closed=%d members=%d", groupID, group.Count(GroupMemberCompleted), group.Closed(), len(group.Members))
+		tracked.Decided = true
+		return composed(ctx, h, data)
+	}
+}
+
+// recordGroupResult records the result of an activity event in the group the activity is a member of.
+// Groups that were decided are dropped once all of their members have closed.
+func (a *EventCorrelator) recordGroupResult(h swf.HistoryEvent) {
+	if len(a.Groups) == 0 {
+		return
+	}
+	activityID, result := a.groupResult(h)
+	if result == nil {
+		return
+	}
+	for id, group := range a.Groups {
+		if member, ok := group.Members[activityID]; ok {
+			*member = *result
+			if group.Decided && group.Closed() == len(group.Members) {
+				delete(a.Groups, id)
+			}
+			return
+		}
+	}
+}
+
+// groupResult returns the ActivityID and the member result of an activity event, or a nil result for other events.
+func (a *EventCorrelator) groupResult(h swf.HistoryEvent) (string, *GroupMember) {
+	if len(a.Groups) == 0 || h.EventType == nil {
+		return "", nil
+	}
+	var activityID string
+	result := &GroupMember{}
+	switch *h.EventType {
+	case swf.EventTypeActivityTaskCompleted:
+		result.Status = GroupMemberCompleted
+		result.Result = stringValue(h.ActivityTaskCompletedEventAttributes.Result)
+	case swf.EventTypeActivityTaskFailed:
+		result.Status = GroupMemberFailed
+		result.Reason = stringValue(h.ActivityTaskFailedEventAttributes.Reason)
+		result.Details = stringValue(h.ActivityTaskFailedEventAttributes.Details)
+	case swf.EventTypeActivityTaskTimedOut:
+		result.Status = GroupMemberTimedOut
+		result.Reason = stringValue(h.ActivityTaskTimedOutEventAttributes.TimeoutType)
+		result.Details = stringValue(h.ActivityTaskTimedOutEventAttributes.Details)
+	case swf.EventTypeActivityTaskCanceled:
+		result.Status = GroupMemberCanceled
+		result.Details = stringValue(h.ActivityTaskCanceledEventAttributes.Details)
+	case swf.EventTypeScheduleActivityTaskFailed:
+		result.Status = GroupMemberFailed
+		result.Reason = stringValue(h.ScheduleActivityTaskFailedEventAttributes.Cause)
+		activityID = stringValue(h.ScheduleActivityTaskFailedEventAttributes.ActivityID)
+	default:
+		return "", nil
+	}
+	if activityID == "" {
+		activityID = a.safeActivityID(h)
+	}
+	return activityID, result
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
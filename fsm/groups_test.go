@@ -0,0 +1,128 @@
+package fsm
+
+import (
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func groupActivity(id string) swf.Decision {
+	return swf.Decision{
+		DecisionType: S(swf.DecisionTypeScheduleActivityTask),
+		ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{
+			ActivityID:   S(id),
+			ActivityType: &swf.ActivityType{Name: S("work"), Version: S("1")},
+		},
+	}
+}
+
+func TestGroupPolicies(t *testing.T) {
+	group := func(statuses ...string) *GroupInfo {
+		g := &GroupInfo{Members: make(map[string]*GroupMember)}
+		for i, status := range statuses {
+			g.Members[string('a'+rune(i))] = &GroupMember{Status: status}
+		}
+		return g
+	}
+	s, c, f := GroupMemberScheduled, GroupMemberCompleted, GroupMemberFailed
+	cases := []struct {
+		name     string
+		policy   GroupPolicy
+		group    *GroupInfo
+		complete bool
+	}{
+		{"all-running", GroupAll(), group(c, f, s), false},
+		{"all-closed", GroupAll(), group(c, f, f), true},
+		{"any-completed", GroupAny(), group(s, c, s), true},
+		{"any-failed", GroupAny(), group(f, s, s), false},
+		{"any-all-failed", GroupAny(), group(f, f, f), true},
+		{"quorum-reached", GroupQuorum(2), group(c, s, c), true},
+		{"quorum-possible", GroupQuorum(2), group(c, f, s), false},
+		{"quorum-impossible", GroupQuorum(2), group(f, f, c), true},
+		{"fail-fast-running", GroupFailFast(), group(c, c, s), false},
+		{"fail-fast-failed", GroupFailFast(), group(s, s, f), true},
+		{"fail-fast-completed", GroupFailFast(), group(c, c, c), true},
+	}
+	for _, tc := range cases {
+		if tc.policy(tc.group) != tc.complete {
+			t.Fatal("unexpected group completion", tc.name, !tc.complete)
+		}
+	}
+}
+
+func TestOnGroupCompleted(t *testing.T) {
+	fsm := testFSM()
+	ctx := testContext(fsm)
+	decisions := ctx.ScheduleGroup("group", groupActivity("a"), groupActivity("b"), groupActivity("c"))
+	if len(decisions) != 3 || len(ctx.Group("group").Members) != 3 {
+		t.Fatal("expected the group to be tracked", decisions, ctx.Group("group"))
+	}
+	for i, d := range decisions {
+		ctx.eventCorrelator.Track(EventFromPayload(i+1, &swf.ActivityTaskScheduledEventAttributes{
+			ActivityID:   d.ScheduleActivityTaskDecisionAttributes.ActivityID,
+			ActivityType: d.ScheduleActivityTaskDecisionAttributes.ActivityType,
+		}))
+	}
+
+	var results map[string]string
+	decider := OnGroupCompleted("group", GroupQuorum(2), func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		results = make(map[string]string)
+		for id, member := range ctx.Group("group").Members {
+			results[id] = member.Status + ":" + member.Result + member.Reason
+		}
+		return ctx.Goto("done", data, nil)
+	})
+	decide := func(h swf.HistoryEvent) Outcome {
+		return ctx.Decide(h, &TestData{}, decider)
+	}
+
+	first := EventFromPayload(4, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventID: L(1), Result: S("one")})
+	decider(ctx, first, &TestData{})
+	if member := ctx.eventCorrelator.Groups["group"].Members["a"]; member.Status != GroupMemberScheduled {
+		t.Fatal("expected the result to be recorded by the correlator, not the decider", member)
+	}
+	if outcome := decide(first); outcome.State != "" {
+		t.Fatal("expected the group to wait for a quorum", outcome)
+	}
+	if member := ctx.Group("group").Members["a"]; member.Status != GroupMemberCompleted || member.Result != "one" {
+		t.Fatal("expected the correlator to record the result", member)
+	}
+	if outcome := decide(EventFromPayload(5, &swf.ActivityTaskFailedEventAttributes{ScheduledEventID: L(2), Reason: S("broken")})); outcome.State != "" {
+		t.Fatal("expected the group to wait for the last member", outcome)
+	}
+	if outcome := decide(EventFromPayload(6, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventID: L(3), Result: S("three")})); outcome.State != "done" {
+		t.Fatal("expected the group to complete", outcome)
+	}
+	expected := map[string]string{"a": "completed:one", "b": "failed:broken", "c": "completed:three"}
+	for id, result := range expected {
+		if results[id] != result {
+			t.Fatal("expected the results of the members", results)
+		}
+	}
+	if ctx.Group("group") != nil {
+		t.Fatal("expected the decided group to be dropped once all its members closed")
+	}
+}
+
+func TestGroupsSurviveContinuation(t *testing.T) {
+	fsm := testFSM()
+	ctx := testContext(fsm)
+	ctx.ScheduleGroup("group", groupActivity("a"))
+
+	cont := ctx.ContinueWorkflowDecision("InitialState", &TestData{})
+	continued := swf.HistoryEvent{
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:                   cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+			ContinuedExecutionRunID: S("previous"),
+		},
+	}
+	correlator, err := fsm.findSerializedEventCorrelator([]swf.HistoryEvent{continued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group := correlator.Groups["group"]; group == nil || group.Members["a"].Status != GroupMemberScheduled {
+		t.Fatal("expected the group to be carried over", correlator.Groups)
+	}
+}
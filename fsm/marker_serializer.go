@@ -0,0 +1,533 @@
+package fsm
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	"github.com/juju/errors"
+)
+
+const (
+	// markerEnvelopePrefix starts every binary marker. json never starts with it, so plain json markers are read as before.
+	markerEnvelopePrefix = "pb"
+	// markerEnvelopeVersion is the version of the binary marker encoding written by MarkerSerializer.
+	markerEnvelopeVersion = 1
+)
+
+// MarkerSerializer is a StateSerializer for the FSM managed markers (FSM.State, FSM.Correlator and FSM.Error).
+//
+// It writes json, or when Binary is set, a compact protobuf encoding of SerializedState and EventCorrelator
+// inside a versioned envelope, "pb<version>:<base64 protobuf>". The protobuf encoding keeps the state data as raw bytes,
+// so it is not escaped a second time as it is when a json encoded state is wrapped in a json encoded marker.
+// There is no protobuf message for swf.HistoryEvent, so SerializedErrorState, and an EventCorrelator with Stashed events,
+// are written as json even when Binary is set.
+//
+// It reads markers written in either format, so Binary can be switched on (or back off) while workflows are open.
+type MarkerSerializer struct {
+	Binary bool
+}
+
+// Serialize serializes the marker. Types other than SerializedState and EventCorrelator are always serialized as json.
+func (m MarkerSerializer) Serialize(state interface{}) (string, error) {
+	if !m.Binary {
+		return JSONStateSerializer{}.Serialize(state)
+	}
+
+	var msg proto.Message
+	switch s := state.(type) {
+	case *SerializedState:
+		msg = toPBState(s)
+	case SerializedState:
+		msg = toPBState(&s)
+	case *EventCorrelator:
+		if len(s.Stashed) > 0 {
+			return JSONStateSerializer{}.Serialize(state)
+		}
+		msg = toPBCorrelator(s)
+	case EventCorrelator:
+		if len(s.Stashed) > 0 {
+			return JSONStateSerializer{}.Serialize(state)
+		}
+		msg = toPBCorrelator(&s)
+	default:
+		return JSONStateSerializer{}.Serialize(state)
+	}
+
+	bin, err := proto.Marshal(msg)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fmt.Sprintf("%s%d:%s", markerEnvelopePrefix, markerEnvelopeVersion, base64.StdEncoding.EncodeToString(bin)), nil
+}
+
+// Deserialize deserializes a marker written in either the json or the binary format.
+func (m MarkerSerializer) Deserialize(serialized string, state interface{}) error {
+	version, payload, ok := parseMarkerEnvelope(serialized)
+	if !ok {
+		return JSONStateSerializer{}.Deserialize(serialized, state)
+	}
+
+	if version != markerEnvelopeVersion {
+		return errors.Errorf("unsupported marker encoding version=%d", version)
+	}
+
+	bin, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	switch s := state.(type) {
+	case *SerializedState:
+		pb := new(pbSerializedState)
+		if err := proto.Unmarshal(bin, pb); err != nil {
+			return errors.Trace(err)
+		}
+		*s = *pb.toState()
+	case *EventCorrelator:
+		pb := new(pbEventCorrelator)
+		if err := proto.Unmarshal(bin, pb); err != nil {
+			return errors.Trace(err)
+		}
+		*s = *pb.toCorrelator()
+	default:
+		return errors.Errorf("cant deserialize binary marker into %T", state)
+	}
+	return nil
+}
+
+func parseMarkerEnvelope(serialized string) (int, string, bool) {
+	if !strings.HasPrefix(serialized, markerEnvelopePrefix) {
+		return 0, "", false
+	}
+	sep := strings.Index(serialized, ":")
+	if sep < 0 {
+		return 0, "", false
+	}
+	version, err := strconv.Atoi(serialized[len(markerEnvelopePrefix):sep])
+	if err != nil {
+		return 0, "", false
+	}
+	return version, serialized[sep+1:], true
+}
+
+func toPBState(s *SerializedState) *pbSerializedState {
+	return &pbSerializedState{
+		StateVersion: proto.Uint64(s.StateVersion),
+		StateName:    proto.String(s.StateName),
+		StateData:    []byte(s.StateData),
+		DataVersion:  proto.Int64(int64(s.DataVersion)),
+	}
+}
+
+func (m *pbSerializedState) toState() *SerializedState {
+	return &SerializedState{
+		StateVersion: m.GetStateVersion(),
+		StateName:    m.GetStateName(),
+		StateData:    string(m.StateData),
+		DataVersion:  int(m.GetDataVersion()),
+	}
+}
+
+func toPBCorrelator(c *EventCorrelator) *pbEventCorrelator {
+	pb := &pbEventCorrelator{}
+	for _, k := range sortedKeys(c.Activities) {
+		info := c.Activities[k]
+		a := &pbActivityInfo{Key: proto.String(k), ActivityID: proto.String(info.ActivityID)}
+		if info.ActivityType != nil {
+			a.Name = info.ActivityType.Name
+			a.Version = info.ActivityType.Version
+		}
+		pb.Activities = append(pb.Activities, a)
+	}
+	pb.ActivityAttempts = toPBCounts(c.ActivityAttempts)
+	for _, k := range sortedKeys(c.Signals) {
+		info := c.Signals[k]
+		pb.Signals = append(pb.Signals, &pbSignalInfo{
+			Key:        proto.String(k),
+			SignalName: proto.String(info.SignalName),
+			WorkflowID: proto.String(info.WorkflowID),
+		})
+	}
+	pb.SignalAttempts = toPBCounts(c.SignalAttempts)
+	for _, k := range sortedKeys(c.Timers) {
+		info := c.Timers[k]
+		pb.Timers = append(pb.Timers, &pbTimerInfo{
+			Key:      proto.String(k),
+			Control:  proto.String(info.Control),
+			TimerID:  proto.String(info.TimerID),
+			FireTime: proto.Int64(info.FireTime),
+		})
+	}
+	pb.Versions = toPBCounts(c.Versions)
+	pb.SideEffects = toPBEntries(c.SideEffects)
+	if c.Close != nil {
+		pb.Close = &pbCloseInfo{
+			DecisionType:   proto.String(c.Close.DecisionType),
+			State:          proto.String(c.Close.State),
+			NextState:      proto.String(c.Close.NextState),
+			ContinuedState: proto.String(c.Close.ContinuedState),
+			Reason:         proto.String(c.Close.Reason),
+			Details:        proto.String(c.Close.Details),
+			Attempts:       proto.Int64(int64(c.Close.Attempts)),
+		}
+	}
+	for _, k := range sortedKeys(c.Children) {
+		info := c.Children[k]
+		child := &pbChildInfo{Key: proto.String(k), WorkflowID: proto.String(info.WorkflowID)}
+		if info.WorkflowType != nil {
+			child.Name = info.WorkflowType.Name
+			child.Version = info.WorkflowType.Version
+		}
+		pb.Children = append(pb.Children, child)
+	}
+	if c.Continuing {
+		pb.Continuing = proto.Bool(true)
+	}
+	for _, k := range sortedKeys(c.Groups) {
+		info := c.Groups[k]
+		group := &pbGroupInfo{Key: proto.String(k)}
+		if info.Decided {
+			group.Decided = proto.Bool(true)
+		}
+		for _, id := range sortedKeys(info.Members) {
+			member := info.Members[id]
+			group.Members = append(group.Members, &pbGroupMember{
+				ActivityID: proto.String(id),
+				Status:     proto.String(member.Status),
+				Result:     proto.String(member.Result),
+				Reason:     proto.String(member.Reason),
+				Details:    proto.String(member.Details),
+			})
+		}
+		pb.Groups = append(pb.Groups, group)
+	}
+	pb.Fired = sortedKeys(c.Fired)
+	return pb
+}
+
+func (m *pbEventCorrelator) toCorrelator() *EventCorrelator {
+	c := &EventCorrelator{}
+	c.checkInit()
+	for _, a := range m.Activities {
+		info := &ActivityInfo{ActivityID: a.GetActivityID()}
+		if a.Name != nil || a.Version != nil {
+			info.ActivityType = &swf.ActivityType{Name: a.Name, Version: a.Version}
+		}
+		c.Activities[a.GetKey()] = info
+	}
+	fromPBCounts(m.ActivityAttempts, c.ActivityAttempts)
+	for _, s := range m.Signals {
+		c.Signals[s.GetKey()] = &SignalInfo{SignalName: s.GetSignalName(), WorkflowID: s.GetWorkflowID()}
+	}
+	fromPBCounts(m.SignalAttempts, c.SignalAttempts)
+	for _, t := range m.Timers {
+		c.Timers[t.GetKey()] = &TimerInfo{Control: t.GetControl(), TimerID: t.GetTimerID(), FireTime: t.GetFireTime()}
+	}
+	if len(m.Versions) > 0 {
+		c.Versions = make(map[string]int)
+		fromPBCounts(m.Versions, c.Versions)
+	}
+	if len(m.SideEffects) > 0 {
+		c.SideEffects = make(map[string]string)
+		fromPBEntries(m.SideEffects, c.SideEffects)
+	}
+	if m.Close != nil {
+		c.Close = &CloseInfo{
+			DecisionType:   m.Close.GetDecisionType(),
+			State:          m.Close.GetState(),
+			NextState:      m.Close.GetNextState(),
+			ContinuedState: m.Close.GetContinuedState(),
+			Reason:         m.Close.GetReason(),
+			Details:        m.Close.GetDetails(),
+			Attempts:       int(m.Close.GetAttempts()),
+		}
+	}
+	if len(m.Children) > 0 {
+		c.Children = make(map[string]*ChildInfo)
+		for _, child := range m.Children {
+			info := &ChildInfo{WorkflowID: child.GetWorkflowID()}
+			if child.Name != nil || child.Version != nil {
+				info.WorkflowType = &swf.WorkflowType{Name: child.Name, Version: child.Version}
+			}
+			c.Children[child.GetKey()] = info
+		}
+	}
+	c.Continuing = m.Continuing != nil && *m.Continuing
+	if len(m.Groups) > 0 {
+		c.Groups = make(map[string]*GroupInfo)
+		for _, group := range m.Groups {
+			info := &GroupInfo{Members: make(map[string]*GroupMember), Decided: group.Decided != nil && *group.Decided}
+			for _, member := range group.Members {
+				info.Members[member.GetActivityID()] = &GroupMember{
+					Status:  member.GetStatus(),
+					Result:  member.GetResult(),
+					Reason:  member.GetReason(),
+					Details: member.GetDetails(),
+				}
+			}
+			c.Groups[group.GetKey()] = info
+		}
+	}
+	if len(m.Fired) > 0 {
+		c.Fired = make(map[string]bool)
+		for _, id := range m.Fired {
+			c.Fired[id] = true
+		}
+	}
+	return c
+}
+
+func toPBCounts(counts map[string]int) []*pbCount {
+	var pb []*pbCount
+	for _, k := range sortedKeys(counts) {
+		pb = append(pb, &pbCount{Key: proto.String(k), Count: proto.Int64(int64(counts[k]))})
+	}
+	return pb
+}
+
+func fromPBCounts(pb []*pbCount, counts map[string]int) {
+	for _, c := range pb {
+		counts[c.GetKey()] = int(c.GetCount())
+	}
+}
+
+func toPBEntries(entries map[string]string) []*pbEntry {
+	var pb []*pbEntry
+	for _, k := range sortedKeys(entries) {
+		pb = append(pb, &pbEntry{Key: proto.String(k), Value: proto.String(entries[k])})
+	}
+	return pb
+}
+
+func fromPBEntries(pb []*pbEntry, entries map[string]string) {
+	for _, e := range pb {
+		entries[e.GetKey()] = e.GetValue()
+	}
+}
+
+// sortedKeys returns the sorted keys of a map with string keys, so binary markers are stable.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//The pb* types are protobuf messages for the binary marker encoding, written in the style of generated code.
+
+type pbSerializedState struct {
+	StateVersion *uint64 `protobuf:"varint,1,opt,name=stateVersion" json:"stateVersion,omitempty"`
+	StateName    *string `protobuf:"bytes,2,opt,name=stateName" json:"stateName,omitempty"`
+	StateData    []byte  `protobuf:"bytes,3,opt,name=stateData" json:"stateData,omitempty"`
+	DataVersion  *int64  `protobuf:"varint,4,opt,name=dataVersion" json:"dataVersion,omitempty"`
+}
+
+func (m *pbSerializedState) Reset()         { *m = pbSerializedState{} }
+func (m *pbSerializedState) String() string { return proto.CompactTextString(m) }
+func (*pbSerializedState) ProtoMessage()    {}
+
+func (m *pbSerializedState) GetStateVersion() uint64 {
+	if m != nil && m.StateVersion != nil {
+		return *m.StateVersion
+	}
+	return 0
+}
+
+func (m *pbSerializedState) GetDataVersion() int64 {
+	if m != nil && m.DataVersion != nil {
+		return *m.DataVersion
+	}
+	return 0
+}
+
+func (m *pbSerializedState) GetStateName() string {
+	if m != nil && m.StateName != nil {
+		return *m.StateName
+	}
+	return ""
+}
+
+type pbEventCorrelator struct {
+	Activities       []*pbActivityInfo `protobuf:"bytes,1,rep,name=activities" json:"activities,omitempty"`
+	ActivityAttempts []*pbCount        `protobuf:"bytes,2,rep,name=activityAttempts" json:"activityAttempts,omitempty"`
+	Signals          []*pbSignalInfo   `protobuf:"bytes,3,rep,name=signals" json:"signals,omitempty"`
+	SignalAttempts   []*pbCount        `protobuf:"bytes,4,rep,name=signalAttempts" json:"signalAttempts,omitempty"`
+	Timers           []*pbTimerInfo    `protobuf:"bytes,5,rep,name=timers" json:"timers,omitempty"`
+	Versions         []*pbCount        `protobuf:"bytes,6,rep,name=versions" json:"versions,omitempty"`
+	SideEffects      []*pbEntry        `protobuf:"bytes,7,rep,name=sideEffects" json:"sideEffects,omitempty"`
+	//8 is not used, correlators with stashed events are written as json
+	Close      *pbCloseInfo   `protobuf:"bytes,9,opt,name=close" json:"close,omitempty"`
+	Children   []*pbChildInfo `protobuf:"bytes,10,rep,name=children" json:"children,omitempty"`
+	Continuing *bool          `protobuf:"varint,11,opt,name=continuing" json:"continuing,omitempty"`
+	Groups     []*pbGroupInfo `protobuf:"bytes,12,rep,name=groups" json:"groups,omitempty"`
+	Fired      []string       `protobuf:"bytes,13,rep,name=fired" json:"fired,omitempty"`
+}
+
+func (m *pbEventCorrelator) Reset()         { *m = pbEventCorrelator{} }
+func (m *pbEventCorrelator) String() string { return proto.CompactTextString(m) }
+func (*pbEventCorrelator) ProtoMessage()    {}
+
+type pbActivityInfo struct {
+	Key        *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	ActivityID *string `protobuf:"bytes,2,opt,name=activityId" json:"activityId,omitempty"`
+	Name       *string `protobuf:"bytes,3,opt,name=name" json:"name,omitempty"`
+	Version    *string `protobuf:"bytes,4,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *pbActivityInfo) Reset()         { *m = pbActivityInfo{} }
+func (m *pbActivityInfo) String() string { return proto.CompactTextString(m) }
+func (*pbActivityInfo) ProtoMessage()    {}
+
+func (m *pbActivityInfo) GetKey() string        { return pbString(m.Key) }
+func (m *pbActivityInfo) GetActivityID() string { return pbString(m.ActivityID) }
+
+type pbSignalInfo struct {
+	Key        *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	SignalName *string `protobuf:"bytes,2,opt,name=signalName" json:"signalName,omitempty"`
+	WorkflowID *string `protobuf:"bytes,3,opt,name=workflowId" json:"workflowId,omitempty"`
+}
+
+func (m *pbSignalInfo) Reset()         { *m = pbSignalInfo{} }
+func (m *pbSignalInfo) String() string { return proto.CompactTextString(m) }
+func (*pbSignalInfo) ProtoMessage()    {}
+
+func (m *pbSignalInfo) GetKey() string        { return pbString(m.Key) }
+func (m *pbSignalInfo) GetSignalName() string { return pbString(m.SignalName) }
+func (m *pbSignalInfo) GetWorkflowID() string { return pbString(m.WorkflowID) }
+
+type pbChildInfo struct {
+	Key        *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	WorkflowID *string `protobuf:"bytes,2,opt,name=workflowId" json:"workflowId,omitempty"`
+	Name       *string `protobuf:"bytes,3,opt,name=name" json:"name,omitempty"`
+	Version    *string `protobuf:"bytes,4,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *pbChildInfo) Reset()         { *m = pbChildInfo{} }
+func (m *pbChildInfo) String() string { return proto.CompactTextString(m) }
+func (*pbChildInfo) ProtoMessage()    {}
+
+func (m *pbChildInfo) GetKey() string        { return pbString(m.Key) }
+func (m *pbChildInfo) GetWorkflowID() string { return pbString(m.WorkflowID) }
+
+type pbTimerInfo struct {
+	Key      *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Control  *string `protobuf:"bytes,2,opt,name=control" json:"control,omitempty"`
+	TimerID  *string `protobuf:"bytes,3,opt,name=timerId" json:"timerId,omitempty"`
+	FireTime *int64  `protobuf:"varint,4,opt,name=fireTime" json:"fireTime,omitempty"`
+}
+
+func (m *pbTimerInfo) Reset()         { *m = pbTimerInfo{} }
+func (m *pbTimerInfo) String() string { return proto.CompactTextString(m) }
+func (*pbTimerInfo) ProtoMessage()    {}
+
+func (m *pbTimerInfo) GetKey() string     { return pbString(m.Key) }
+func (m *pbTimerInfo) GetControl() string { return pbString(m.Control) }
+func (m *pbTimerInfo) GetTimerID() string { return pbString(m.TimerID) }
+func (m *pbTimerInfo) GetFireTime() int64 {
+	if m != nil && m.FireTime != nil {
+		return *m.FireTime
+	}
+	return 0
+}
+
+type pbCloseInfo struct {
+	DecisionType   *string `protobuf:"bytes,1,opt,name=decisionType" json:"decisionType,omitempty"`
+	State          *string `protobuf:"bytes,2,opt,name=state" json:"state,omitempty"`
+	NextState      *string `protobuf:"bytes,3,opt,name=nextState" json:"nextState,omitempty"`
+	ContinuedState *string `protobuf:"bytes,4,opt,name=continuedState" json:"continuedState,omitempty"`
+	Reason         *string `protobuf:"bytes,5,opt,name=reason" json:"reason,omitempty"`
+	Details        *string `protobuf:"bytes,6,opt,name=details" json:"details,omitempty"`
+	Attempts       *int64  `protobuf:"varint,7,opt,name=attempts" json:"attempts,omitempty"`
+}
+
+func (m *pbCloseInfo) Reset()         { *m = pbCloseInfo{} }
+func (m *pbCloseInfo) String() string { return proto.CompactTextString(m) }
+func (*pbCloseInfo) ProtoMessage()    {}
+
+func (m *pbCloseInfo) GetDecisionType() string   { return pbString(m.DecisionType) }
+func (m *pbCloseInfo) GetState() string          { return pbString(m.State) }
+func (m *pbCloseInfo) GetNextState() string      { return pbString(m.NextState) }
+func (m *pbCloseInfo) GetContinuedState() string { return pbString(m.ContinuedState) }
+func (m *pbCloseInfo) GetReason() string         { return pbString(m.Reason) }
+func (m *pbCloseInfo) GetDetails() string        { return pbString(m.Details) }
+func (m *pbCloseInfo) GetAttempts() int64 {
+	if m != nil && m.Attempts != nil {
+		return *m.Attempts
+	}
+	return 0
+}
+
+type pbGroupInfo struct {
+	Key     *string          `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Members []*pbGroupMember `protobuf:"bytes,2,rep,name=members" json:"members,omitempty"`
+	Decided *bool            `protobuf:"varint,3,opt,name=decided" json:"decided,omitempty"`
+}
+
+func (m *pbGroupInfo) Reset()         { *m = pbGroupInfo{} }
+func (m *pbGroupInfo) String() string { return proto.CompactTextString(m) }
+func (*pbGroupInfo) ProtoMessage()    {}
+
+func (m *pbGroupInfo) GetKey() string { return pbString(m.Key) }
+
+type pbGroupMember struct {
+	ActivityID *string `protobuf:"bytes,1,opt,name=activityId" json:"activityId,omitempty"`
+	Status     *string `protobuf:"bytes,2,opt,name=status" json:"status,omitempty"`
+	Result     *string `protobuf:"bytes,3,opt,name=result" json:"result,omitempty"`
+	Reason     *string `protobuf:"bytes,4,opt,name=reason" json:"reason,omitempty"`
+	Details    *string `protobuf:"bytes,5,opt,name=details" json:"details,omitempty"`
+}
+
+func (m *pbGroupMember) Reset()         { *m = pbGroupMember{} }
+func (m *pbGroupMember) String() string { return proto.CompactTextString(m) }
+func (*pbGroupMember) ProtoMessage()    {}
+
+func (m *pbGroupMember) GetActivityID() string { return pbString(m.ActivityID) }
+func (m *pbGroupMember) GetStatus() string     { return pbString(m.Status) }
+func (m *pbGroupMember) GetResult() string     { return pbString(m.Result) }
+func (m *pbGroupMember) GetReason() string     { return pbString(m.Reason) }
+func (m *pbGroupMember) GetDetails() string    { return pbString(m.Details) }
+
+type pbCount struct {
+	Key   *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Count *int64  `protobuf:"varint,2,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *pbCount) Reset()         { *m = pbCount{} }
+func (m *pbCount) String() string { return proto.CompactTextString(m) }
+func (*pbCount) ProtoMessage()    {}
+
+func (m *pbCount) GetKey() string { return pbString(m.Key) }
+
+func (m *pbCount) GetCount() int64 {
+	if m != nil && m.Count != nil {
+		return *m.Count
+	}
+	return 0
+}
+
+type pbEntry struct {
+	Key   *string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Value *string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *pbEntry) Reset()         { *m = pbEntry{} }
+func (m *pbEntry) String() string { return proto.CompactTextString(m) }
+func (*pbEntry) ProtoMessage()    {}
+
+func (m *pbEntry) GetKey() string   { return pbString(m.Key) }
+func (m *pbEntry) GetValue() string { return pbString(m.Value) }
+
+func pbString(s *string) string {
+	if s != nil {
+		return *s
+	}
+	return ""
+}
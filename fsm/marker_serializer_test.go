@@ -0,0 +1,189 @@
+package fsm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func testMarkerCorrelator() *EventCorrelator {
+	c := &EventCorrelator{}
+	c.checkInit()
+	c.Activities["5"] = &ActivityInfo{ActivityID: "activity", ActivityType: &swf.ActivityType{Name: S("name"), Version: S("1")}}
+	c.ActivityAttempts["activity"] = 2
+	c.Signals["6"] = &SignalInfo{SignalName: "signal", WorkflowID: "other"}
+	c.SignalAttempts["other->signal"] = 1
+	c.Timers["7"] = &TimerInfo{Control: "control", TimerID: "timer", FireTime: 1000}
+	c.recordVersion("change", 2)
+	c.recordSideEffect("lookup@8", `"value"`)
+	c.stash(swf.HistoryEvent{EventID: I(9), EventType: S(swf.EventTypeWorkflowExecutionSignaled)}, DefaultStashLimit)
+	c.Close = &CloseInfo{
+		DecisionType:   swf.DecisionTypeContinueAsNewWorkflowExecution,
+		State:          "working",
+		NextState:      "working",
+		ContinuedState: "continued",
+		Reason:         "reason",
+		Details:        "details",
+		Attempts:       1,
+	}
+	c.Children = map[string]*ChildInfo{"10": &ChildInfo{WorkflowID: "child", WorkflowType: &swf.WorkflowType{Name: S("child"), Version: S("1")}}}
+	c.Continuing = true
+	c.Groups = map[string]*GroupInfo{
+		"group": &GroupInfo{Members: map[string]*GroupMember{
+			"activity": &GroupMember{Status: GroupMemberCompleted, Result: "done"},
+			"other":    &GroupMember{Status: GroupMemberFailed, Reason: "reason", Details: "details"},
+		}, Decided: true},
+		"scheduled": &GroupInfo{Members: map[string]*GroupMember{"next": &GroupMember{Status: GroupMemberScheduled}}},
+	}
+	c.Fired = map[string]bool{"greeted": true}
+	return c
+}
+
+func TestMarkerCorrelatorFillsEveryField(t *testing.T) {
+	c := reflect.ValueOf(*testMarkerCorrelator())
+	for i := 0; i < c.NumField(); i++ {
+		if reflect.DeepEqual(c.Field(i).Interface(), reflect.Zero(c.Field(i).Type()).Interface()) {
+			t.Fatal("expected the test correlator to set", c.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestMarkerSerializerRoundTrips(t *testing.T) {
+	state := &SerializedState{StateVersion: 12, StateName: "working", StateData: `{"States":["a","b"]}`}
+	errorState := &SerializedErrorState{
+		EarliestUnprocessedEventID: 4,
+		LatestUnprocessedEventID:   9,
+		ErrorEvent:                 swf.HistoryEvent{EventID: I(5), EventType: S(swf.EventTypeWorkflowExecutionSignaled)},
+		Attempts:                   2,
+		StateName:                  "working",
+	}
+	correlator := testMarkerCorrelator()
+	unstashed := testMarkerCorrelator()
+	unstashed.Stashed = nil
+
+	for _, ser := range []MarkerSerializer{MarkerSerializer{}, MarkerSerializer{Binary: true}} {
+		serialized, err := ser.Serialize(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ser.Binary != strings.HasPrefix(serialized, "pb1:") {
+			t.Fatal("unexpected envelope", ser.Binary, serialized)
+		}
+		readState := &SerializedState{}
+		if err := ser.Deserialize(serialized, readState); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(state, readState) {
+			t.Fatal(state, readState)
+		}
+
+		//stashed events are always written as json
+		for _, c := range []*EventCorrelator{unstashed, correlator} {
+			serialized, err = ser.Serialize(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if binary := ser.Binary && len(c.Stashed) == 0; binary != strings.HasPrefix(serialized, "pb1:") {
+				t.Fatal("unexpected envelope", binary, serialized)
+			}
+			readCorrelator := &EventCorrelator{}
+			if err := ser.Deserialize(serialized, readCorrelator); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c, readCorrelator) {
+				t.Fatalf("%+v %+v", c, readCorrelator)
+			}
+		}
+
+		serialized, err = ser.Serialize(*errorState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(serialized, "pb1:") {
+			t.Fatal("expected the error state to be written as json", serialized)
+		}
+		readError := &SerializedErrorState{}
+		if err := ser.Deserialize(serialized, readError); err != nil {
+			t.Fatal(err)
+		}
+		if readError.LatestUnprocessedEventID != 9 || *readError.ErrorEvent.EventID != 5 || readError.Attempts != 2 || readError.StateName != "working" {
+			t.Fatal(readError)
+		}
+	}
+}
+
+func TestMarkerSerializerReadsEitherFormat(t *testing.T) {
+	state := &SerializedState{StateVersion: 1, StateName: "working", StateData: `{}`}
+	json, _ := MarkerSerializer{}.Serialize(state)
+	binary, _ := MarkerSerializer{Binary: true}.Serialize(state)
+
+	if len(binary) >= len(json) {
+		t.Fatal("expected binary encoding to be more compact", binary, json)
+	}
+
+	for _, ser := range []MarkerSerializer{MarkerSerializer{}, MarkerSerializer{Binary: true}} {
+		for _, serialized := range []string{json, binary} {
+			read := &SerializedState{}
+			if err := ser.Deserialize(serialized, read); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(state, read) {
+				t.Fatal(state, read)
+			}
+		}
+	}
+
+	if err := (MarkerSerializer{}).Deserialize("pb2:AAAA", &SerializedState{}); err == nil {
+		t.Fatal("expected unsupported version error")
+	}
+}
+
+func TestBinaryMarkersInTick(t *testing.T) {
+	fsm := testFSM()
+	fsm.SystemSerializer = MarkerSerializer{Binary: true}
+	fsm.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			return f.Goto("next", data, nil)
+		},
+	})
+	fsm.AddState(&FSMState{
+		Name: "next",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			return f.Stay(data, nil)
+		},
+	})
+
+	events := []swf.HistoryEvent{
+		swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventID: I(3)},
+		swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventID: I(2)},
+		swf.HistoryEvent{
+			EventID:   I(1),
+			EventType: S("WorkflowExecutionStarted"),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				Input: S(fsm.Serialize(new(TestData))),
+			},
+		},
+	}
+	_, decisions, _, err := fsm.Tick(testDecisionTask(0, events))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marker := FindDecision(decisions, stateMarkerPredicate)
+	if !strings.HasPrefix(*marker.RecordMarkerDecisionAttributes.Details, "pb1:") {
+		t.Fatal("expected binary state marker", *marker.RecordMarkerDecisionAttributes.Details)
+	}
+
+	secondEvents := append(DecisionsToEvents(decisions), events...)
+	state, err := fsm.findSerializedState(secondEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.StateName != "next" {
+		t.Fatal("expected to read binary state marker", state)
+	}
+}
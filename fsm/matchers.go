@@ -0,0 +1,148 @@
+package fsm
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+)
+
+// EventMatcher is a building block for composable deciders, a predicate on the event being decided, the FSMContext and the FSM stateData.
+// Matchers are combined with And, Or and Not, and fire deciders with When.
+type EventMatcher func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool
+
+// When builds a composed decider that fires when the matcher matches.
+func When(matcher EventMatcher, deciders ...Decider) Decider {
+	composed := NewComposedDecider(deciders...)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if matcher(ctx, h, data) {
+			logf(ctx, "at=when")
+			return composed(ctx, h, data)
+		}
+		return ctx.Pass()
+	}
+}
+
+// Once builds a composed decider that fires only the first time it is reached in a workflow, including its continued runs.
+// That it fired is remembered in the EventCorrelator under the id, which must be unique among the Once deciders of the FSM.
+// It is usually wrapped in a matcher, like When or OnSignalReceived, so it fires the first time an event matches.
+func Once(id string, deciders ...Decider) Decider {
+	composed := NewComposedDecider(deciders...)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if ctx.eventCorrelator.Fired[id] {
+			return ctx.Pass()
+		}
+		logf(ctx, "at=once id=%s", id)
+		outcome := composed(ctx, h, data)
+		//marked after the deciders return, so a decider that panics fires again when the event is decided again
+		if ctx.eventCorrelator.Fired == nil {
+			ctx.eventCorrelator.Fired = make(map[string]bool)
+		}
+		ctx.eventCorrelator.Fired[id] = true
+		return outcome
+	}
+}
+
+// And builds an EventMatcher that matches when all of the matchers match.
+func And(matchers ...EventMatcher) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		for _, m := range matchers {
+			if !m(ctx, h, data) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or builds an EventMatcher that matches when any of the matchers match.
+func Or(matchers ...EventMatcher) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		for _, m := range matchers {
+			if m(ctx, h, data) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not builds an EventMatcher that matches when the matcher does not.
+func Not(matcher EventMatcher) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		return !matcher(ctx, h, data)
+	}
+}
+
+// DataMatches builds an EventMatcher from a PredicateFunc on the FSM stateData.
+func DataMatches(predicate PredicateFunc) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		return predicate(data)
+	}
+}
+
+// InState builds an EventMatcher that matches when the workflow is in one of the states, or in a child of one of them.
+func InState(states ...string) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		var current *FSMState
+		if fsm := ctx.fsm(); fsm != nil {
+			current = fsm.states[ctx.State]
+		}
+		for _, state := range states {
+			if ctx.State == state || (current != nil && ctx.fsm().inState(current, state)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// EventType builds an EventMatcher that matches events of the types.
+func EventType(eventTypes ...string) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		for _, eventType := range eventTypes {
+			if *h.EventType == eventType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AttemptsAtMost builds an EventMatcher that matches events of activities and sent signals that have been attempted at most n times,
+// see EventCorrelator.AttemptsForActivity and EventCorrelator.AttemptsForSignal. Other events always match.
+func AttemptsAtMost(n int) EventMatcher {
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		if info := ctx.ActivityInfo(h); info != nil {
+			return ctx.eventCorrelator.AttemptsForActivity(info) <= n
+		}
+		if info := ctx.SignalInfo(h); info != nil {
+			return ctx.eventCorrelator.AttemptsForSignal(info) <= n
+		}
+		return true
+	}
+}
+
+// SignalInputMatches builds an EventMatcher that matches a received signal with signalName whose input satisfies a func(*P) bool,
+// where P is the type of the signal payload. The input is deserialized into a new *P, which is nil when the signal has no input.
+// The typing is checked at construction time, and against the type registered with FSM.AddSignal when a signal is received.
+func SignalInputMatches(signalName string, predicate interface{}) EventMatcher {
+	t := reflect.TypeOf(predicate)
+	if t == nil || reflect.Func != t.Kind() {
+		panic(fmt.Sprintf("kind was %v, not Func", t))
+	}
+	if t.NumIn() != 1 || t.In(0).Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("arguments were %v, not a single pointer", t))
+	}
+	typeCheck(predicate, []string{t.In(0).String()}, []string{"bool"})
+	payloadType := t.In(0)
+	v := reflect.ValueOf(predicate)
+	return func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool {
+		if *h.EventType != swf.EventTypeWorkflowExecutionSignaled || *h.WorkflowExecutionSignaledEventAttributes.SignalName != signalName {
+			return false
+		}
+		checkSignalType(ctx, signalName, payloadType)
+		payload := payloadValue(ctx, h.WorkflowExecutionSignaledEventAttributes.Input, payloadType)
+		return v.Call([]reflect.Value{payload})[0].Bool()
+	}
+}
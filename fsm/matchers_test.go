@@ -0,0 +1,128 @@
+package fsm
+
+import (
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func TestMatcherCombinators(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddInitialState(&FSMState{Name: "parent", Decider: DefaultDecider()})
+	fsm.AddState(&FSMState{Name: "child", Parent: "parent", Decider: DefaultDecider()})
+	ctx := testContext(fsm)
+	ctx.State = "child"
+	signal := EventFromPayload(1, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("hello"), Input: S(`{"Field":"hi"}`)})
+	yes := func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) bool { return true }
+	no := Not(yes)
+
+	cases := []struct {
+		name    string
+		matcher EventMatcher
+		matches bool
+	}{
+		{"and", And(yes, yes), true},
+		{"and-no", And(yes, no), false},
+		{"or", Or(no, yes), true},
+		{"or-no", Or(no, no), false},
+		{"not", Not(no), true},
+		{"in-state", InState("other", "child"), true},
+		{"in-parent-state", InState("parent"), true},
+		{"not-in-state", InState("other"), false},
+		{"event-type", EventType(swf.EventTypeTimerFired, swf.EventTypeWorkflowExecutionSignaled), true},
+		{"not-event-type", EventType(swf.EventTypeTimerFired), false},
+		{"data", DataMatches(func(data interface{}) bool { return len(data.(*TestData).States) == 1 }), true},
+		{"signal-input", SignalInputMatches("hello", func(p *TestingType) bool { return p.Field == "hi" }), true},
+		{"signal-input-no", SignalInputMatches("hello", func(p *TestingType) bool { return p.Field == "bye" }), false},
+		{"signal-name-no", SignalInputMatches("other", func(p *TestingType) bool { return true }), false},
+		{"attempts-other-event", AttemptsAtMost(0), true},
+	}
+	for _, tc := range cases {
+		if tc.matcher(ctx, signal, &TestData{States: []string{"a"}}) != tc.matches {
+			t.Fatal("unexpected match", tc.name, !tc.matches)
+		}
+	}
+}
+
+func TestAttemptsAtMost(t *testing.T) {
+	ctx := testContext(testFSM())
+	ctx.eventCorrelator.Track(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{
+		ActivityID:   S("activity"),
+		ActivityType: &swf.ActivityType{Name: S("activity"), Version: S("1")},
+	}))
+	ctx.eventCorrelator.ActivityAttempts["activity"] = 2
+	failed := EventFromPayload(2, &swf.ActivityTaskFailedEventAttributes{ScheduledEventID: L(1)})
+	if AttemptsAtMost(1)(ctx, failed, nil) {
+		t.Fatal("expected 2 attempts to be more than 1")
+	}
+	if !AttemptsAtMost(2)(ctx, failed, nil) {
+		t.Fatal("expected 2 attempts to be at most 2")
+	}
+}
+
+func TestWhenOnce(t *testing.T) {
+	ctx := testContext(testFSM())
+	fired := 0
+	decider := When(EventType(swf.EventTypeWorkflowExecutionSignaled), Once("greet",
+		func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+			fired++
+			return ctx.Goto("greeted", data, nil)
+		}))
+	timer := EventFromPayload(1, &swf.TimerFiredEventAttributes{TimerID: S("timer")})
+	signal := EventFromPayload(2, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("hello")})
+
+	if outcome := decider(ctx, timer, &TestData{}); outcome.State != "" || fired != 0 {
+		t.Fatal("expected events that do not match to pass", outcome)
+	}
+	if outcome := decider(ctx, signal, &TestData{}); outcome.State != "greeted" || fired != 1 {
+		t.Fatal("expected the first match to fire", outcome)
+	}
+	if outcome := decider(ctx, signal, &TestData{}); outcome.State != "" || fired != 1 {
+		t.Fatal("expected later matches to pass", outcome)
+	}
+
+	//firing is remembered across continue-as-new
+	fsm := testFSM()
+	cont := ctx.ContinueWorkflowDecision("InitialState", &TestData{})
+	continued := EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+		Input:                   cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+		ContinuedExecutionRunID: S("previous"),
+	})
+	correlator, err := fsm.findSerializedEventCorrelator([]swf.HistoryEvent{continued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !correlator.Fired["greet"] {
+		t.Fatal("expected the fired Once to be carried over", correlator.Fired)
+	}
+}
+
+func TestOnceFiresAgainAfterPanic(t *testing.T) {
+	ctx := testContext(testFSM())
+	failing := true
+	decider := Once("greet", func(ctx *FSMContext, h swf.HistoryEvent, data interface{}) Outcome {
+		if failing {
+			panic("boom")
+		}
+		return ctx.Goto("greeted", data, nil)
+	})
+	signal := EventFromPayload(1, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("hello")})
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected the decider to panic")
+			}
+		}()
+		decider(ctx, signal, &TestData{})
+	}()
+	if ctx.eventCorrelator.Fired["greet"] {
+		t.Fatal("expected a Once that panicked not to be marked as fired")
+	}
+
+	failing = false
+	if outcome := decider(ctx, signal, &TestData{}); outcome.State != "greeted" || !ctx.eventCorrelator.Fired["greet"] {
+		t.Fatal("expected the Once to fire when the event is decided again", outcome)
+	}
+}
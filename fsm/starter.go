@@ -0,0 +1,186 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	"github.com/juju/errors"
+	"github.com/sclasen/swfsm/poller"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+// ScheduledStart is a workflow execution the CronStarter starts at the times of a cron spec.
+type ScheduledStart struct {
+	// Name of the schedule, used in logs and in the default WorkflowID.
+	Name string
+	// Spec is the cron spec of the times to start the workflow at, see ParseCron.
+	Spec string
+	// WorkflowID is a text/template for the ID of the workflow started at a time, executed with the Name and Time of the start,
+	// like "reconcile-{{.Time.Format \"2006-01-02\"}}". Defaults to "{{.Name}}-{{.Time.Format \"20060102T1504Z0700\"}}".
+	// The ID should be the same for each time, and different for different times, as it is what keeps several CronStarters
+	// from starting the same workflow twice.
+	WorkflowID string
+	// Input, if set, builds the input of the workflow started at a time.
+	Input func(at time.Time) (interface{}, error)
+	// StartTemplate holds the WorkflowType, TaskList, timeouts and the like for the started workflows. The Domain, WorkflowID and Input are set by the CronStarter.
+	StartTemplate swf.StartWorkflowExecutionInput
+	cron          CronSchedule
+	id            *template.Template
+}
+
+// DefaultCronSkew is the default CronStarter.Skew.
+const DefaultCronSkew = 5 * time.Minute
+
+// CronStarter starts workflow executions on schedules with FSMClient.Start, like a nightly reconciliation.
+// Several CronStarters can run the same schedules, as a workflow ID is the same for each of them. SWF refuses to start
+// a workflow with the ID of one that is running, with a WorkflowExecutionAlreadyStartedFault, which is not an error for a CronStarter,
+// and a CronStarter does not start a workflow when an execution with its ID that was started since Skew before its time has closed.
+// A workflow that closes between that check and the start, or that closed longer ago than the retention period of the domain,
+// can still be started twice. Times that pass while no CronStarter is running are skipped.
+type CronStarter struct {
+	// Name of the CronStarter, used in logs and to register with the ShutdownManager.
+	Name string
+	// Client used to start the workflows.
+	Client FSMClient
+	// ShutdownManager stops the CronStarter along with the pollers. Defaults to a new ShutdownManager.
+	ShutdownManager *poller.ShutdownManager
+	// Location the cron specs are in. Defaults to UTC.
+	Location *time.Location
+	// Skew is how far apart the clocks of CronStarters running the same schedules can be. Defaults to DefaultCronSkew.
+	Skew   time.Duration
+	starts []*ScheduledStart
+	now    func() time.Time
+	after  func(time.Duration) <-chan time.Time
+}
+
+// AddStart adds a ScheduledStart to the CronStarter. It returns an error if the Spec or WorkflowID do not parse.
+func (c *CronStarter) AddStart(start *ScheduledStart) error {
+	cron, err := ParseCron(start.Spec)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	idTemplate := start.WorkflowID
+	if idTemplate == "" {
+		idTemplate = `{{.Name}}-{{.Time.Format "20060102T1504Z0700"}}`
+	}
+	id, err := template.New(start.Name).Parse(idTemplate)
+	if err != nil {
+		return errors.Annotatef(err, "bad workflow id template for %s", start.Name)
+	}
+	start.cron = cron
+	start.id = id
+	c.starts = append(c.starts, start)
+	return nil
+}
+
+// Start starts the CronStarter in a goroutine, which runs until the ShutdownManager stops it.
+func (c *CronStarter) Start() {
+	c.init()
+	stop := make(chan bool, 1)
+	stopAck := make(chan bool, 1)
+	c.ShutdownManager.Register(c.registeredName(), stop, stopAck)
+	go c.run(stop, stopAck)
+}
+
+func (c *CronStarter) init() {
+	if c.ShutdownManager == nil {
+		c.ShutdownManager = poller.NewShutdownManager()
+	}
+	if c.Location == nil {
+		c.Location = time.UTC
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.after == nil {
+		c.after = time.After
+	}
+}
+
+func (c *CronStarter) registeredName() string {
+	return fmt.Sprintf("%s-cron-starter", c.Name)
+}
+
+func (c *CronStarter) run(stop chan bool, stopAck chan bool) {
+	next := make([]time.Time, len(c.starts))
+	for i, start := range c.starts {
+		next[i] = start.cron.Next(c.now().In(c.Location))
+	}
+	for {
+		var due time.Time
+		for _, at := range next {
+			if !at.IsZero() && (due.IsZero() || at.Before(due)) {
+				due = at
+			}
+		}
+		var wait <-chan time.Time
+		if !due.IsZero() {
+			wait = c.after(due.Sub(c.now()))
+		}
+		select {
+		case <-stop:
+			c.log("at=recieved-stop action=shutting-down")
+			stopAck <- true
+			return
+		case <-wait:
+			for i, start := range c.starts {
+				if next[i].Equal(due) {
+					if err := c.StartAt(start, due); err != nil {
+						c.log("at=start-error schedule=%s time=%s error=%q", start.Name, due.Format(time.RFC3339), err.Error())
+					}
+					next[i] = start.cron.Next(due)
+				}
+			}
+		}
+	}
+}
+
+// StartAt starts the workflow of a ScheduledStart for a time. A workflow that was already started for the time, by this
+// or another CronStarter, is not an error, whether it is still open or has closed.
+func (c *CronStarter) StartAt(start *ScheduledStart, at time.Time) error {
+	var id bytes.Buffer
+	err := start.id.Execute(&id, struct {
+		Name string
+		Time time.Time
+	}{start.Name, at})
+	if err != nil {
+		return errors.Annotatef(err, "bad workflow id template for %s", start.Name)
+	}
+	var input interface{}
+	if start.Input != nil {
+		if input, err = start.Input(at); err != nil {
+			return errors.Annotatef(err, "building input for %s", start.Name)
+		}
+	}
+	skew := c.Skew
+	if skew == 0 {
+		skew = DefaultCronSkew
+	}
+	closed, err := c.Client.ClosedSince(id.String(), at.Add(-skew))
+	if err != nil {
+		return errors.Annotatef(err, "finding closed executions of %s", id.String())
+	}
+	if closed != nil {
+		c.log("at=already-closed schedule=%s workflow-id=%s", start.Name, id.String())
+		return nil
+	}
+	_, err = c.Client.Start(start.StartTemplate, id.String(), input)
+	if isAPIError(err, ErrorTypeWorkflowExecutionAlreadyStartedFault) {
+		c.log("at=already-started schedule=%s workflow-id=%s", start.Name, id.String())
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.log("at=started schedule=%s workflow-id=%s", start.Name, id.String())
+	return nil
+}
+
+func (c *CronStarter) log(format string, data ...interface{}) {
+	actualFormat := fmt.Sprintf("component=CronStarter name=%s %s", c.Name, format)
+	log.Printf(actualFormat, data...)
+}
@@ -0,0 +1,147 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+type MockStartSWF struct {
+	*swf.SWF
+	started chan string
+	ids     map[string]bool
+	inputs  map[string]string
+	closed  map[string]time.Time
+}
+
+func (m *MockStartSWF) ListClosedWorkflowExecutions(req *swf.ListClosedWorkflowExecutionsInput) (*swf.WorkflowExecutionInfos, error) {
+	infos := &swf.WorkflowExecutionInfos{}
+	if started, ok := m.closed[*req.ExecutionFilter.WorkflowID]; ok && !started.Before(req.StartTimeFilter.OldestDate.Time) {
+		infos.ExecutionInfos = append(infos.ExecutionInfos, swf.WorkflowExecutionInfo{
+			Execution: &swf.WorkflowExecution{WorkflowID: req.ExecutionFilter.WorkflowID, RunID: S("closed")},
+		})
+	}
+	return infos, nil
+}
+
+func (m *MockStartSWF) StartWorkflowExecution(req *swf.StartWorkflowExecutionInput) (*swf.Run, error) {
+	if m.ids[*req.WorkflowID] {
+		return nil, aws.APIError{Type: ErrorTypeWorkflowExecutionAlreadyStartedFault, Message: "already started"}
+	}
+	m.ids[*req.WorkflowID] = true
+	if req.Input != nil {
+		m.inputs[*req.WorkflowID] = *req.Input
+	}
+	m.started <- *req.WorkflowID
+	return &swf.Run{RunID: S("run")}, nil
+}
+
+func cronStarterTestClient(mock *MockStartSWF) FSMClient {
+	fsm := &FSM{
+		Domain:           "starter-test",
+		Name:             "test-fsm",
+		DataType:         TestData{},
+		Serializer:       JSONStateSerializer{},
+		SystemSerializer: JSONStateSerializer{},
+	}
+	return NewFSMClient(fsm, mock)
+}
+
+func TestCronStarterStartsOnce(t *testing.T) {
+	mock := &MockStartSWF{started: make(chan string, 10), ids: make(map[string]bool), inputs: make(map[string]string)}
+	start := &ScheduledStart{
+		Name:       "reconcile",
+		Spec:       "@daily",
+		WorkflowID: `reconcile-{{.Time.Format "2006-01-02"}}`,
+		Input: func(at time.Time) (interface{}, error) {
+			return &TestData{States: []string{at.Format("2006-01-02")}}, nil
+		},
+		StartTemplate: swf.StartWorkflowExecutionInput{WorkflowType: &swf.WorkflowType{Name: S("reconcile"), Version: S("1")}},
+	}
+	at := time.Date(2015, 6, 10, 0, 0, 0, 0, time.UTC)
+
+	//two starters running the same schedule start the workflow once
+	for i := 0; i < 2; i++ {
+		starter := &CronStarter{Name: "test", Client: cronStarterTestClient(mock)}
+		if err := starter.AddStart(start); err != nil {
+			t.Fatal(err)
+		}
+		if err := starter.StartAt(start, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mock.ids) != 1 || !mock.ids["reconcile-2015-06-10"] {
+		t.Fatal("expected the workflow to be started once", mock.ids)
+	}
+	if mock.inputs["reconcile-2015-06-10"] == "" {
+		t.Fatal("expected the input to be built")
+	}
+
+	//a run with the same id that already closed is not started again, by a starter whose clock is behind
+	mock.closed = map[string]time.Time{"reconcile-2015-06-11": time.Date(2015, 6, 10, 23, 59, 0, 0, time.UTC)}
+	next := time.Date(2015, 6, 11, 0, 0, 0, 0, time.UTC)
+	starter := &CronStarter{Name: "test", Client: cronStarterTestClient(mock)}
+	if err := starter.StartAt(start, next); err != nil {
+		t.Fatal(err)
+	}
+	if mock.ids["reconcile-2015-06-11"] {
+		t.Fatal("expected the closed run not to be started again")
+	}
+	//a run started longer than the skew before the time does not count
+	starter.Skew = 30 * time.Second
+	if err := starter.StartAt(start, next); err != nil {
+		t.Fatal(err)
+	}
+	if !mock.ids["reconcile-2015-06-11"] {
+		t.Fatal("expected a run closed before the skew not to count")
+	}
+
+	for _, bad := range []*ScheduledStart{{Name: "bad-spec", Spec: "* *"}, {Name: "bad-id", Spec: "@daily", WorkflowID: "{{.Nope"}} {
+		if err := starter.AddStart(bad); err == nil {
+			t.Fatal("expected a bad start to be refused", bad.Name)
+		}
+	}
+}
+
+func TestCronStarterRunsUntilShutdown(t *testing.T) {
+	mock := &MockStartSWF{started: make(chan string, 10), ids: make(map[string]bool), inputs: make(map[string]string)}
+	now := time.Date(2015, 6, 10, 10, 30, 0, 0, time.UTC)
+	waits := make(chan time.Duration, 10)
+	fire := make(chan time.Time)
+	starter := &CronStarter{
+		Name:   "test",
+		Client: cronStarterTestClient(mock),
+		now:    func() time.Time { return now },
+		after: func(d time.Duration) <-chan time.Time {
+			waits <- d
+			return fire
+		},
+	}
+	if err := starter.AddStart(&ScheduledStart{Name: "hourly", Spec: "@hourly"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := starter.AddStart(&ScheduledStart{Name: "half", Spec: "30 * * * *"}); err != nil {
+		t.Fatal(err)
+	}
+	starter.Start()
+
+	if wait := <-waits; wait != 30*time.Minute {
+		t.Fatal("expected to wait for the next hour", wait)
+	}
+	now = now.Add(30 * time.Minute)
+	fire <- now
+	if id := <-mock.started; id != "hourly-20150610T1100Z" {
+		t.Fatal("expected the hourly workflow to start", id)
+	}
+	if wait := <-waits; wait != 30*time.Minute {
+		t.Fatal("expected to wait for the half hour", wait)
+	}
+
+	starter.ShutdownManager.StopPollers()
+	if len(mock.ids) != 1 {
+		t.Fatal("expected one workflow to be started", mock.ids)
+	}
+}
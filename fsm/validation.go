@@ -0,0 +1,157 @@
+package fsm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+)
+
+// MaxDecisions is the most decisions SWF accepts in a RespondDecisionTaskCompleted.
+const MaxDecisions = 100
+
+// InvalidDecisionsError is returned by ValidateDecisions when decisions have problems it can not fix.
+type InvalidDecisionsError struct {
+	Problems []string
+}
+
+func (e *InvalidDecisionsError) Error() string {
+	return "invalid decisions: " + strings.Join(e.Problems, ", ")
+}
+
+// ValidateDecisions checks decisions for the problems SWF would reject them for, before they are sent.
+// Problems that are safe to fix are fixed: a decision that is repeated exactly is dropped, and the decision
+// that closes the workflow is moved last. Decisions missing required attributes, timers or activities started twice with
+// different attributes without a cancel between them, conflicting close decisions, and more than MaxDecisions decisions are returned as an InvalidDecisionsError.
+func ValidateDecisions(decisions []swf.Decision) ([]swf.Decision, error) {
+	return validateDecisions(decisions, MaxDecisions)
+}
+
+// validateDecisions is ValidateDecisions with room for limit decisions, so the FSM can leave room for its markers.
+func validateDecisions(decisions []swf.Decision, limit int) ([]swf.Decision, error) {
+	var problems []string
+	valid := make([]swf.Decision, 0, len(decisions))
+	var closing []swf.Decision
+	timers := make(map[string]swf.Decision)
+	activities := make(map[string]swf.Decision)
+
+	for i, d := range decisions {
+		if missing := missingAttributes(d); len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("decision %d %s missing %s", i, safeDecisionType(d), strings.Join(missing, " ")))
+			continue
+		}
+		switch *d.DecisionType {
+		case swf.DecisionTypeStartTimer:
+			id := *d.StartTimerDecisionAttributes.TimerID
+			if started, ok := timers[id]; ok {
+				if !reflect.DeepEqual(started, d) {
+					problems = append(problems, "timer "+id+" started twice")
+				}
+				continue
+			}
+			timers[id] = d
+		case swf.DecisionTypeScheduleActivityTask:
+			id := *d.ScheduleActivityTaskDecisionAttributes.ActivityID
+			if scheduled, ok := activities[id]; ok {
+				if !reflect.DeepEqual(scheduled, d) {
+					problems = append(problems, "activity "+id+" scheduled twice")
+				}
+				continue
+			}
+			activities[id] = d
+		case swf.DecisionTypeCancelTimer:
+			//a timer canceled by an earlier decision can be started again
+			delete(timers, *d.CancelTimerDecisionAttributes.TimerID)
+		case swf.DecisionTypeRequestCancelActivityTask:
+			delete(activities, *d.RequestCancelActivityTaskDecisionAttributes.ActivityID)
+		}
+		if isCloseDecision(d) {
+			if len(closing) > 0 {
+				if !reflect.DeepEqual(closing[0], d) {
+					problems = append(problems, fmt.Sprintf("conflicting close decisions %s and %s", *closing[0].DecisionType, *d.DecisionType))
+				}
+				continue
+			}
+			closing = append(closing, d)
+			continue
+		}
+		valid = append(valid, d)
+	}
+
+	valid = append(valid, closing...)
+	if len(valid) > limit {
+		problems = append(problems, fmt.Sprintf("%d decisions, more than %d", len(valid), limit))
+	}
+	if len(problems) > 0 {
+		return decisions, &InvalidDecisionsError{Problems: problems}
+	}
+	return valid, nil
+}
+
+// missingAttributes returns the names of the attributes SWF requires that a decision does not have.
+func missingAttributes(d swf.Decision) []string {
+	var missing []string
+	require := func(name string, present bool) {
+		if !present {
+			missing = append(missing, name)
+		}
+	}
+	if d.DecisionType == nil {
+		return []string{"DecisionType"}
+	}
+	switch *d.DecisionType {
+	case swf.DecisionTypeScheduleActivityTask:
+		a := d.ScheduleActivityTaskDecisionAttributes
+		require("ScheduleActivityTaskDecisionAttributes", a != nil)
+		if a != nil {
+			require("ActivityID", a.ActivityID != nil && *a.ActivityID != "")
+			require("ActivityType", a.ActivityType != nil && a.ActivityType.Name != nil && a.ActivityType.Version != nil)
+		}
+	case swf.DecisionTypeRequestCancelActivityTask:
+		a := d.RequestCancelActivityTaskDecisionAttributes
+		require("ActivityID", a != nil && a.ActivityID != nil && *a.ActivityID != "")
+	case swf.DecisionTypeRecordMarker:
+		a := d.RecordMarkerDecisionAttributes
+		require("MarkerName", a != nil && a.MarkerName != nil && *a.MarkerName != "")
+	case swf.DecisionTypeStartTimer:
+		a := d.StartTimerDecisionAttributes
+		require("StartTimerDecisionAttributes", a != nil)
+		if a != nil {
+			require("TimerID", a.TimerID != nil && *a.TimerID != "")
+			require("StartToFireTimeout", a.StartToFireTimeout != nil && *a.StartToFireTimeout != "")
+		}
+	case swf.DecisionTypeCancelTimer:
+		a := d.CancelTimerDecisionAttributes
+		require("TimerID", a != nil && a.TimerID != nil && *a.TimerID != "")
+	case swf.DecisionTypeSignalExternalWorkflowExecution:
+		a := d.SignalExternalWorkflowExecutionDecisionAttributes
+		require("SignalExternalWorkflowExecutionDecisionAttributes", a != nil)
+		if a != nil {
+			require("WorkflowID", a.WorkflowID != nil && *a.WorkflowID != "")
+			require("SignalName", a.SignalName != nil && *a.SignalName != "")
+		}
+	case swf.DecisionTypeRequestCancelExternalWorkflowExecution:
+		a := d.RequestCancelExternalWorkflowExecutionDecisionAttributes
+		require("WorkflowID", a != nil && a.WorkflowID != nil && *a.WorkflowID != "")
+	case swf.DecisionTypeStartChildWorkflowExecution:
+		a := d.StartChildWorkflowExecutionDecisionAttributes
+		require("StartChildWorkflowExecutionDecisionAttributes", a != nil)
+		if a != nil {
+			require("WorkflowID", a.WorkflowID != nil && *a.WorkflowID != "")
+			require("WorkflowType", a.WorkflowType != nil && a.WorkflowType.Name != nil && a.WorkflowType.Version != nil)
+		}
+	case swf.DecisionTypeCompleteWorkflowExecution, swf.DecisionTypeFailWorkflowExecution,
+		swf.DecisionTypeCancelWorkflowExecution, swf.DecisionTypeContinueAsNewWorkflowExecution:
+	default:
+		require("known DecisionType", false)
+	}
+	return missing
+}
+
+func safeDecisionType(d swf.Decision) string {
+	if d.DecisionType == nil {
+		return "nil"
+	}
+	return *d.DecisionType
+}
@@ -0,0 +1,157 @@
+package fsm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/gen/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func validationTimer(id string, timeout string) swf.Decision {
+	return swf.Decision{
+		DecisionType:                 S(swf.DecisionTypeStartTimer),
+		StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{TimerID: S(id), StartToFireTimeout: S(timeout)},
+	}
+}
+
+func validationComplete(result string) swf.Decision {
+	return swf.Decision{
+		DecisionType: S(swf.DecisionTypeCompleteWorkflowExecution),
+		CompleteWorkflowExecutionDecisionAttributes: &swf.CompleteWorkflowExecutionDecisionAttributes{Result: S(result)},
+	}
+}
+
+func TestValidateDecisionsFixesSafeProblems(t *testing.T) {
+	decisions := []swf.Decision{
+		validationTimer("a", "10"),
+		validationComplete("done"),
+		validationTimer("a", "10"),
+		validationTimer("b", "10"),
+		validationComplete("done"),
+	}
+	valid, err := ValidateDecisions(decisions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []swf.Decision{validationTimer("a", "10"), validationTimer("b", "10"), validationComplete("done")}
+	if !reflect.DeepEqual(valid, expected) {
+		t.Fatal("expected duplicates to be dropped and the close decision moved last", valid)
+	}
+}
+
+func TestValidateDecisionsReportsProblems(t *testing.T) {
+	decisions := []swf.Decision{
+		validationTimer("a", "10"),
+		validationTimer("a", "20"),
+		swf.Decision{DecisionType: S(swf.DecisionTypeScheduleActivityTask), ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{}},
+		validationComplete("done"),
+		swf.Decision{DecisionType: S(swf.DecisionTypeFailWorkflowExecution), FailWorkflowExecutionDecisionAttributes: &swf.FailWorkflowExecutionDecisionAttributes{}},
+	}
+	_, err := ValidateDecisions(decisions)
+	invalid, ok := err.(*InvalidDecisionsError)
+	if !ok || len(invalid.Problems) != 3 {
+		t.Fatal("expected 3 problems", err)
+	}
+	for i, expected := range []string{"timer a started twice", "missing ActivityID ActivityType", "conflicting close decisions"} {
+		if !strings.Contains(invalid.Problems[i], expected) {
+			t.Fatal("expected", expected, "got", invalid.Problems[i])
+		}
+	}
+
+	many := make([]swf.Decision, MaxDecisions+1)
+	for i := range many {
+		many[i] = validationTimer(strings.Repeat("t", i+1), "10")
+	}
+	if _, err := ValidateDecisions(many); err == nil {
+		t.Fatal("expected too many decisions to be reported")
+	}
+}
+
+func TestValidateDecisionsAllowsRestartAfterCancel(t *testing.T) {
+	cancel := swf.Decision{
+		DecisionType:                  S(swf.DecisionTypeCancelTimer),
+		CancelTimerDecisionAttributes: &swf.CancelTimerDecisionAttributes{TimerID: S("a")},
+	}
+	decisions := []swf.Decision{validationTimer("a", "10"), cancel, validationTimer("a", "20")}
+	valid, err := ValidateDecisions(decisions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(valid, decisions) {
+		t.Fatal("expected a canceled timer to be started again", valid)
+	}
+}
+
+func TestInvalidDecisionsReserveStateChunks(t *testing.T) {
+	fsm := testFSM()
+	fsm.allowPanics = false
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			if *h.EventType != swf.EventTypeWorkflowExecutionSignaled {
+				return f.Stay(d, nil)
+			}
+			//a state split across 3 chunk markers, and decisions that would fit with only the 2 unsplit markers
+			d.(*TestData).States = append(d.(*TestData).States, strings.Repeat("s", 2*MaxMarkerDetailsSize+1))
+			decisions := make([]swf.Decision, MaxDecisions-2)
+			for i := range decisions {
+				decisions[i] = validationTimer(strings.Repeat("t", i+1), "10")
+			}
+			return f.Stay(d, decisions)
+		},
+	})
+	fsm.Init()
+
+	_, decisions, _, _ := fsm.Tick(testDecisionTask(0, errorRecoveryTestEvents(fsm)))
+	if len(decisions) > MaxDecisions {
+		t.Fatal("expected the state chunk markers to be counted", len(decisions))
+	}
+	if !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker, ErrorMarker}) {
+		t.Fatal("expected the decisions to be reported as invalid", systemMarkerNames(decisions))
+	}
+}
+
+func TestInvalidDecisionsRecordErrorState(t *testing.T) {
+	fsm := testFSM()
+	fsm.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(f *FSMContext, h swf.HistoryEvent, d interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				d.(*TestData).States = append(d.(*TestData).States, "signaled")
+				return f.Stay(d, []swf.Decision{validationTimer("a", "10"), validationTimer("a", "20")})
+			}
+			return f.Stay(d, nil)
+		},
+	})
+	fsm.Init()
+
+	ctx, decisions, _, err := fsm.Tick(testDecisionTask(0, errorRecoveryTestEvents(fsm)))
+	if _, ok := err.(*InvalidDecisionsError); !ok {
+		t.Fatal("expected the invalid decisions to be returned", err)
+	}
+	if !reflect.DeepEqual(systemMarkerNames(decisions), []string{StateMarker, CorrelatorMarker, ErrorMarker}) || len(decisions) != 3 {
+		t.Fatal("expected only the markers of an error state", decisions)
+	}
+	errorState := new(SerializedErrorState)
+	fsm.SystemSerializer.Deserialize(*decisions[2].RecordMarkerDecisionAttributes.Details, errorState)
+	if *errorState.ErrorEvent.EventID != 1 || errorState.EarliestUnprocessedEventID != 1 || errorState.LatestUnprocessedEventID != 2 {
+		t.Fatal("expected all the events to be unprocessed", errorState)
+	}
+	if len(ctx.stateData.(*TestData).States) != 0 {
+		t.Fatal("expected the state before the decision task", ctx.stateData)
+	}
+
+	//a DecisionErrorHandler can rescue invalid decisions
+	fsm.DecisionErrorHandler = func(f *FSMContext, h swf.HistoryEvent, before interface{}, after interface{}, err error) (*Outcome, error) {
+		return &Outcome{State: f.State, Data: after, Decisions: []swf.Decision{validationTimer("a", "10")}}, nil
+	}
+	ctx, decisions, _, err = fsm.Tick(testDecisionTask(0, errorRecoveryTestEvents(fsm)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 3 || *decisions[2].DecisionType != swf.DecisionTypeStartTimer || len(ctx.stateData.(*TestData).States) != 1 {
+		t.Fatal("expected the rescued decisions", decisions, ctx.stateData)
+	}
+}